@@ -11,8 +11,13 @@ import (
 type Trees struct {
 	trees []*conf
 	// Name of the package.
-	Pkg     string
+	Pkg string
+	// Import paths by package name.
 	Imports map[string]string
+	// Import paths of the packages that field types can refer to,
+	// by package name. Packages that aren't here are assumed to
+	// be imported by their name, like the standard library.
+	FieldPkgs map[string]string
 }
 
 type conf struct {
@@ -26,24 +31,66 @@ type conf struct {
 	LinkN string
 	// How to compare two nodes...
 	CmpF string
-	// Compare node to value.
-	CmpVal     string
-	CmpValType string
+	// ...unless it's a three-way compare function that CmpF adapts.
+	Cmp3 string
+	// Fields to generate CmpF and a cmpval from.
+	KeyFields []keyField
+	// The tree is in descending order, CmpF inverts CmpDesc.
+	Desc    bool
+	CmpDesc string
+	// Functions to compare nodes to values.
+	CmpVals []*cmpVal
 	// Name of the iterator type.
 	IterT string
+	// Keep the number of elements of each subtree in the link.
+	Size bool
+	// Keep a pointer to the parent node in the link.
+	Parent bool
+	// Node method that recomputes user data from the children.
+	Augment string
+	// Interval tree, names and type of the start and end fields.
+	IvStart string
+	IvEnd   string
+	IvType  string
+	// What insert does with equal elements: allow, ignore, reject
+	// or replace.
+	Dups string
 
 	// Generated function names
 	F map[string]string
+	// Types of the fields in the node type.
+	fields map[string]string
+}
+
+// Split the tag on the commas that aren't inside parentheses or
+// brackets.
+func splitTag(tag string) []string {
+	var s []string
+	depth, st := 0, 0
+	for i, r := range tag {
+		switch r {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				s = append(s, tag[st:i])
+				st = i + 1
+			}
+		}
+	}
+	return append(s, tag[st:])
 }
 
 func (c *conf) parseTag(tag string) error {
-	s := strings.Split(tag, ",")
+	s := splitTag(tag)
 	// The first element is always the name of the tree type.
 	c.TreeT = s[0]
 	s = s[1:]
 	export := false
 	// The rest of the elements are split key:value pairs
-	for i := range s {
+	for i := 0; i < len(s); i++ {
 		kv := strings.SplitN(s[i], ":", 2)
 		if len(kv) == 1 {
 			switch kv[0] {
@@ -56,6 +103,23 @@ func (c *conf) parseTag(tag string) error {
 				c.IterT = c.TreeT + "Iter"
 			case "export":
 				export = true
+			case "rank":
+				c.Size = true
+				c.F["nth"] = "nth"
+				c.F["rank"] = "rank"
+				c.F["rankVal"] = "rankVal"
+				c.F["countRange"] = "countRange"
+			case "seq":
+				c.F["all"] = "all"
+				c.F["backward"] = "backward"
+				c.F["rangeVal"] = "rangeVal"
+			case "parent":
+				c.Parent = true
+			case "len":
+				c.Size = true
+				c.F["len"] = "len"
+			case "desc":
+				c.Desc = true
 			default:
 				return fmt.Errorf("unknown tag value: %s", s[i])
 			}
@@ -64,54 +128,316 @@ func (c *conf) parseTag(tag string) error {
 			switch k {
 			case "cmp":
 				c.CmpF = v
-			case "cmpval":
-				m := regexp.MustCompile("(.*)\\((.*)\\)").FindStringSubmatch(v)
-				if len(m) != 3 {
-					return fmt.Errorf("invalid cmpval, expected 'cmpval:<fn>(<type>)', got 'cmpval:%s'", v)
+			case "cmp3":
+				c.Cmp3 = v
+				c.CmpF = v + strings.Title(c.TreeT)
+			case "cmpval", "cmpval3":
+				m := regexp.MustCompile("^([^(]*)\\((.*)\\)$").FindStringSubmatch(v)
+				if len(m) != 3 || strings.TrimSpace(m[2]) == "" {
+					return fmt.Errorf("invalid %s, expected '%s:<fn>(<type>[,<type>...])', got '%s:%s'", k, k, k, v)
+				}
+				cv := &cmpVal{conf: c, CmpVal: m[1]}
+				if k == "cmpval3" {
+					cv.Cmp3 = m[1]
+					cv.CmpVal = m[1] + strings.Title(c.TreeT)
 				}
-				c.CmpVal = m[1]
-				c.CmpValType = m[2]
+				for _, t := range splitTag(m[2]) {
+					cv.CmpValTypes = append(cv.CmpValTypes, strings.TrimSpace(t))
+				}
+				c.CmpVals = append(c.CmpVals, cv)
 			case "no":
 				delete(c.F, v)
+			case "interval":
+				// The end field is the next element.
+				if i+1 == len(s) {
+					return fmt.Errorf("invalid interval, expected 'interval:<start>,<end>'")
+				}
+				i++
+				c.IvStart, c.IvEnd = v, s[i]
+				st, et := c.fields[c.IvStart], c.fields[c.IvEnd]
+				if st == "" || et == "" {
+					return fmt.Errorf("interval: %s has no fields %s and %s", c.NodeT, c.IvStart, c.IvEnd)
+				}
+				if st != et {
+					return fmt.Errorf("interval: %s and %s have different types", c.IvStart, c.IvEnd)
+				}
+				c.IvType = st
+				c.F["overlaps"] = "overlaps"
+				c.F["stabbing"] = "stabbing"
+				c.F["anyOverlap"] = "anyOverlap"
+			case "key":
+				// The following elements that are field names
+				// and not tag options are part of the key too.
+				c.KeyFields = nil
+				for {
+					err := c.addKeyField(v)
+					if err != nil {
+						return err
+					}
+					if i+1 == len(s) || tagOptions[s[i+1]] || strings.Contains(s[i+1], ":") {
+						break
+					}
+					f := strings.Fields(s[i+1])
+					if len(f) == 0 || c.fields[f[0]] == "" {
+						break
+					}
+					i++
+					v = s[i]
+				}
+				c.CmpF = "keyCmp" + strings.Title(c.TreeT)
+				cv := &cmpVal{conf: c, CmpVal: "keyCmpVal" + strings.Title(c.TreeT), IsKey: true}
+				for i := range c.KeyFields {
+					kf := &c.KeyFields[i]
+					cv.CmpValTypes = append(cv.CmpValTypes, kf.Type)
+					if len(c.KeyFields) > 1 {
+						kf.Arg = fmt.Sprintf("x%d", i)
+					}
+				}
+				c.CmpVals = append(c.CmpVals, cv)
+			case "augment":
+				c.Augment = v
+				c.F["aggregateRange"] = "aggregateRange"
+			case "dups":
+				switch v {
+				case "allow", "ignore", "reject", "replace":
+					c.Dups = v
+				default:
+					return fmt.Errorf("invalid dups, expected 'dups:allow|ignore|reject|replace', got 'dups:%s'", v)
+				}
 			default:
 				return fmt.Errorf("unknown tag value: %s", s[i])
 			}
 		}
 	}
+	if c.Desc && c.IvStart != "" {
+		// The overlap searches prune the tree assuming that the
+		// starts are ascending.
+		return fmt.Errorf("interval: can't be combined with desc")
+	}
 	if export {
 		for k, v := range c.F {
 			c.F[k] = strings.Title(v)
 		}
 	}
+	if c.Desc {
+		// Functions named after an order follow the order of
+		// the compare functions, not the order of the tree.
+		for _, p := range [][2]string{{"searchValGEQ", "searchValLEQ"}, {"floor", "ceiling"}, {"lower", "higher"}, {"floorVal", "ceilingVal"}, {"lowerVal", "higherVal"}} {
+			c.F[p[0]], c.F[p[1]] = c.F[p[1]], c.F[p[0]]
+		}
+	}
+	// The first cmpval gets the plain function names, the others
+	// get the name of the compare function as a suffix.
+	for i, cv := range c.CmpVals {
+		if i > 0 && cv.IsKey {
+			cv.Sfx = "Key"
+		} else if i > 0 && cv.Cmp3 != "" {
+			cv.Sfx = strings.Title(cv.Cmp3)
+		} else if i > 0 {
+			cv.Sfx = strings.Title(cv.CmpVal)
+		}
+		cv.F = make(map[string]string)
+		for k, v := range c.F {
+			if valFuncs[k] {
+				v += cv.Sfx
+			}
+			cv.F[k] = v
+		}
+	}
+	if c.Desc {
+		// Generated compare functions are generated inverted,
+		// the others get wrapped.
+		for i := range c.KeyFields {
+			c.KeyFields[i].Desc = !c.KeyFields[i].Desc
+		}
+		if c.Cmp3 == "" && c.KeyFields == nil {
+			c.CmpDesc = c.CmpF
+			c.CmpF += "Desc" + strings.Title(c.TreeT)
+		}
+		for _, cv := range c.CmpVals {
+			if cv.Cmp3 == "" && !cv.IsKey {
+				cv.CmpValDesc = cv.CmpVal
+				cv.CmpVal += "Desc" + strings.Title(c.TreeT)
+			}
+		}
+	}
+	return nil
+}
+
+// A field that is part of the key.
+type keyField struct {
+	Name string
+	Type string
+	// How to compare it: "ordered", "string", "bytes" or "time".
+	Kind string
+	Desc bool
+	// Name of the argument to the generated cmpval function.
+	Arg string
+}
+
+// Parse "<field>" or "<field> desc" and add it to the key.
+func (c *conf) addKeyField(s string) error {
+	f := strings.Fields(s)
+	if len(f) == 0 || len(f) > 2 || (len(f) == 2 && f[1] != "desc") {
+		return fmt.Errorf("invalid key, expected 'key:<field>[ desc][,<field>[ desc]...]', got '%s'", s)
+	}
+	kf := keyField{Name: f[0], Type: c.fields[f[0]], Kind: "ordered", Desc: len(f) == 2, Arg: "x"}
+	switch kf.Type {
+	case "":
+		return fmt.Errorf("key: %s has no field %s", c.NodeT, kf.Name)
+	case "string":
+		kf.Kind = "string"
+	case "[]byte":
+		kf.Kind = "bytes"
+	case "time.Time":
+		kf.Kind = "time"
+	}
+	c.KeyFields = append(c.KeyFields, kf)
 	return nil
 }
 
+// A function to compare nodes to values and everything generated
+// for it.
+type cmpVal struct {
+	*conf
+	// Name of the function and the types of its arguments.
+	CmpVal      string
+	CmpValTypes []string
+	// Three-way compare function that CmpVal adapts.
+	Cmp3 string
+	// CmpVal inverts this function in a descending tree.
+	CmpValDesc string
+	// CmpVal is generated from the key fields.
+	IsKey bool
+	// Suffix for the names of all the functions.
+	Sfx string
+	// Generated function names
+	F map[string]string
+}
+
+// Functions generated for each cmpval.
+// The tag options without a value, they end the list of key fields.
+var tagOptions = map[string]bool{
+	"foreach": true,
+	"debug":   true,
+	"iter":    true,
+	"export":  true,
+	"rank":    true,
+	"seq":     true,
+	"parent":  true,
+	"len":     true,
+	"desc":    true,
+}
+
+var valFuncs = map[string]bool{
+	"lookupVal":      true,
+	"searchValGEQ":   true,
+	"searchValLEQ":   true,
+	"floorVal":       true,
+	"ceilingVal":     true,
+	"lowerVal":       true,
+	"higherVal":      true,
+	"deleteVal":      true,
+	"getOrInsertVal": true,
+	"split":          true,
+	"deleteRangeVal": true,
+	"rankVal":        true,
+	"countRange":     true,
+	"aggregateRange": true,
+	"rangeVal":       true,
+	"iterVal":        true,
+}
+
+// Parameter declarations for values passed to the cmpval function,
+// one set for each name. With multiple types the parameters are
+// numbered: "x0 string, x1 int64".
+func (c *cmpVal) ValParams(names ...string) string {
+	if len(c.CmpValTypes) == 1 {
+		return strings.Join(names, ", ") + " " + c.CmpValTypes[0]
+	}
+	var p []string
+	for _, n := range names {
+		for i, t := range c.CmpValTypes {
+			p = append(p, fmt.Sprintf("%s%d %s", n, i, t))
+		}
+	}
+	return strings.Join(p, ", ")
+}
+
+// Arguments to pass on the values declared by ValParams.
+func (c *cmpVal) ValArgs(name string) string {
+	if len(c.CmpValTypes) == 1 {
+		return name
+	}
+	a := make([]string, len(c.CmpValTypes))
+	for i := range a {
+		a[i] = fmt.Sprintf("%s%d", name, i)
+	}
+	return strings.Join(a, ", ")
+}
+
+// Does the link carry any data computed from the subtrees other
+// than the height?
+func (c *conf) Augmented() bool {
+	return c.Size || c.Augment != "" || c.IvStart != ""
+}
+
 func New(pkg string) *Trees {
 	return &Trees{Pkg: pkg, Imports: make(map[string]string)}
 }
 
 var defaultFuncs = map[string]string{
-	"insert":       "insert",
-	"delete":       "delete",
-	"lookup":       "lookup",
-	"last":         "last",
-	"first":        "first",
-	"lookupVal":    "lookupVal",
-	"searchValGEQ": "searchValGEQ",
-	"searchValLEQ": "searchValLEQ",
-	"deleteVal":    "deleteVal",
-	"iter":         "iter",
-	"iterVal":      "iterVal",
+	"insert":         "insert",
+	"delete":         "delete",
+	"lookup":         "lookup",
+	"last":           "last",
+	"first":          "first",
+	"popFirst":       "popFirst",
+	"popLast":        "popLast",
+	"clear":          "clear",
+	"next":           "next",
+	"prev":           "prev",
+	"lookupVal":      "lookupVal",
+	"searchValGEQ":   "searchValGEQ",
+	"searchValLEQ":   "searchValLEQ",
+	"floor":          "floor",
+	"ceiling":        "ceiling",
+	"lower":          "lower",
+	"higher":         "higher",
+	"floorVal":       "floorVal",
+	"ceilingVal":     "ceilingVal",
+	"lowerVal":       "lowerVal",
+	"higherVal":      "higherVal",
+	"deleteVal":      "deleteVal",
+	"getOrInsertVal": "getOrInsertVal",
+	"buildSorted":    "buildSorted",
+	"join":           "join",
+	"concat":         "concat",
+	"split":          "split",
+	"deleteRangeVal": "deleteRangeVal",
+	"union":          "union",
+	"intersection":   "intersection",
+	"difference":     "difference",
+	"iter":           "iter",
+	"iterVal":        "iterVal",
 }
 
 func (t *Trees) AddTree(nodeT, linkT, linkN, treeT, tag string) error {
+	return t.AddTreeFields(nodeT, linkT, linkN, treeT, tag, nil)
+}
+
+// Same as AddTree, fields maps the names of the fields in the node
+// type to their types for the tag options that refer to fields.
+func (t *Trees) AddTreeFields(nodeT, linkT, linkN, treeT, tag string, fields map[string]string) error {
 	c := &conf{
-		LinkT: linkT,
-		TreeT: treeT,
-		NodeT: nodeT,
-		LinkN: linkN,
-		CmpF:  "cmp",
-		F:     make(map[string]string),
+		LinkT:  linkT,
+		TreeT:  treeT,
+		NodeT:  nodeT,
+		LinkN:  linkN,
+		CmpF:   "cmp",
+		Dups:   "allow",
+		F:      make(map[string]string),
+		fields: fields,
 	}
 	for k, v := range defaultFuncs {
 		c.F[k] = v
@@ -125,10 +451,47 @@ func (t *Trees) AddTree(nodeT, linkT, linkN, treeT, tag string) error {
 	if c.F["check"] != "" {
 		t.Imports["fmt"] = "fmt"
 	}
+	for _, kf := range c.KeyFields {
+		switch kf.Kind {
+		case "string":
+			t.Imports["strings"] = "strings"
+		case "bytes":
+			t.Imports["bytes"] = "bytes"
+		}
+		t.importType(kf.Type)
+	}
+	if c.F["all"] != "" || c.F["backward"] != "" || (c.CmpVals != nil && c.F["rangeVal"] != "") || (c.IvStart != "" && (c.F["overlaps"] != "" || c.F["stabbing"] != "")) {
+		t.Imports["iter"] = "iter"
+	}
+	if c.IvStart != "" {
+		t.importType(c.IvType)
+	}
 	t.trees = append(t.trees, c)
 	return nil
 }
 
+var qualRe = regexp.MustCompile(`\b([A-Za-z_][A-Za-z0-9_]*)\.[A-Za-z_]`)
+
+// Import the packages that the type expression typ refers to.
+func (t *Trees) importType(typ string) {
+	for _, m := range qualRe.FindAllStringSubmatch(typ, -1) {
+		path := t.FieldPkgs[m[1]]
+		if path == "" {
+			path = m[1]
+		}
+		t.Imports[m[1]] = path
+	}
+}
+
+// Used by the prologue, the name to import path as, followed by a
+// space, or nothing if the last element of the path is the name.
+func (t *Trees) ImportName(name, path string) string {
+	if name == path[strings.LastIndex(path, "/")+1:] {
+		return ""
+	}
+	return name + " "
+}
+
 func (t *Trees) Gen(out io.Writer) error {
 	err := prologueTmpl.Execute(out, t)
 	if err != nil {
@@ -146,8 +509,8 @@ func (t *Trees) Gen(out io.Writer) error {
 var prologueTmpl = template.Must(template.New("prologue").Parse(`// Code generated by "avlgen", do not edit.
 
 package {{.Pkg}}
-{{range .Imports}}
-import "{{.}}"
+{{range $name, $path := .Imports}}
+import {{$.ImportName $name $path}}"{{$path}}"
 {{end}}
 func btoi(a bool) int {
 	// See: https://github.com/golang/go/issues/6011#issuecomment-254303032
@@ -170,9 +533,72 @@ func btoi(a bool) int {
 `))
 
 var treeTmpl = template.Must(template.New("code").Parse(`
+{{- if .Cmp3}}
+// Adapts {{.Cmp3}} to the (equal, less) convention.
+func (a *{{.NodeT}}) {{.CmpF}}(b *{{.NodeT}}) (bool, bool) {
+	c := a.{{.Cmp3}}(b)
+	return c == 0, c {{if .Desc}}>{{else}}<{{end}} 0
+}
+{{end}}
+{{- if .CmpDesc}}
+// Inverts {{.CmpDesc}} for the descending tree.
+func (a *{{.NodeT}}) {{.CmpF}}(b *{{.NodeT}}) (bool, bool) {
+	eq, less := a.{{.CmpDesc}}(b)
+	return eq, !eq && !less
+}
+{{end}}
+{{- range .CmpVals}}
+{{- if .IsKey}}
+// Compares the key fields.
+func (a *{{.NodeT}}) {{.CmpF}}(b *{{.NodeT}}) (bool, bool) {
+	return a.{{.CmpVal}}(
+{{- range $i, $f := .KeyFields}}{{if $i}}, {{end}}b.{{$f.Name}}{{end -}}
+	)
+}
+
+// Compares the key fields to values.
+func (a *{{.NodeT}}) {{.CmpVal}}({{.ValParams "x"}}) (bool, bool) {
+{{- range .KeyFields}}
+{{- if eq .Kind "ordered"}}
+	if a.{{.Name}} != {{.Arg}} {
+		return false, a.{{.Name}} {{if .Desc}}>{{else}}<{{end}} {{.Arg}}
+	}
+{{- else}}
+	if c := {{if eq .Kind "string"}}strings.Compare(a.{{.Name}}, {{.Arg}}){{else if eq .Kind "bytes"}}bytes.Compare(a.{{.Name}}, {{.Arg}}){{else}}a.{{.Name}}.Compare({{.Arg}}){{end}}; c != 0 {
+		return false, c {{if .Desc}}>{{else}}<{{end}} 0
+	}
+{{- end}}
+{{- end}}
+	return true, false
+}
+{{end}}
+{{- if .Cmp3}}
+// Adapts {{.Cmp3}} to the (equal, less) convention.
+func (a *{{.NodeT}}) {{.CmpVal}}({{.ValParams "x"}}) (bool, bool) {
+	c := a.{{.Cmp3}}({{.ValArgs "x"}})
+	return c == 0, c {{if .Desc}}>{{else}}<{{end}} 0
+}
+{{end}}
+{{- if .CmpValDesc}}
+// Inverts {{.CmpValDesc}} for the descending tree.
+func (a *{{.NodeT}}) {{.CmpVal}}({{.ValParams "x"}}) (bool, bool) {
+	eq, less := a.{{.CmpValDesc}}({{.ValArgs "x"}})
+	return eq, !eq && !less
+}
+{{end}}
+{{- end}}
 type {{.LinkT}} struct {
 	nodes  [2]{{.TreeT}}
 	height int
+{{- if .Size}}
+	size   int
+{{- end}}
+{{- if .Parent}}
+	parent *{{.NodeT}}
+{{- end}}
+{{- if .IvStart}}
+	maxEnd {{.IvType}}
+{{- end}}
 }
 
 type {{.TreeT}} struct {
@@ -185,6 +611,24 @@ func (tr *{{.TreeT}}) height() int {
 	}
 	return tr.n.{{.LinkN}}.height
 }
+{{- if .Size}}
+
+func (tr *{{.TreeT}}) size() int {
+	if tr.n == nil {
+		return 0
+	}
+	return tr.n.{{.LinkN}}.size
+}
+{{- end}}
+
+{{- if .Parent}}
+
+func (tr *{{.TreeT}}) setParent(p *{{.NodeT}}) {
+	if tr.n != nil {
+		tr.n.{{.LinkN}}.parent = p
+	}
+}
+{{- end}}
 
 func (tr *{{.TreeT}}) reheight() {
 	l := tr.n.{{.LinkN}}.nodes[0].height()
@@ -194,21 +638,57 @@ func (tr *{{.TreeT}}) reheight() {
 	} else {
 		tr.n.{{.LinkN}}.height = r + 1
 	}
+{{- if .Augmented}}
+	tr.reaugment()
+{{- end}}
+}
+{{- if .Augmented}}
+
+// Recompute everything except the height that the link keeps
+// about the subtree from the children.
+func (tr *{{.TreeT}}) reaugment() {
+{{- if .Size}}
+	tr.n.{{.LinkN}}.size = tr.n.{{.LinkN}}.nodes[0].size() + tr.n.{{.LinkN}}.nodes[1].size() + 1
+{{- end}}
+{{- if .IvStart}}
+	tr.n.{{.LinkN}}.maxEnd = tr.n.{{.IvEnd}}
+	for _, c := range tr.n.{{.LinkN}}.nodes {
+		if c.n != nil && tr.n.{{.LinkN}}.maxEnd < c.n.{{.LinkN}}.maxEnd {
+			tr.n.{{.LinkN}}.maxEnd = c.n.{{.LinkN}}.maxEnd
+		}
+	}
+{{- end}}
+{{- if .Augment}}
+	tr.n.{{.Augment}}(tr.n.{{.LinkN}}.nodes[1].n, tr.n.{{.LinkN}}.nodes[0].n)
+{{- end}}
 }
+{{- end}}
 
-func (tr *{{.TreeT}}) rebalance() {
+// Rebalance the tree after the height of one of its subtrees
+// changed. Returns false if the height of the tree didn't change,
+// then nothing above it needs to be rebalanced.
+func (tr *{{.TreeT}}) rebalance() bool {
+	h := tr.n.{{.LinkN}}.height
 	lh := tr.n.{{.LinkN}}.nodes[0].height()
 	rh := tr.n.{{.LinkN}}.nodes[1].height()
 	if lh > rh {
 		tr.n.{{.LinkN}}.height = lh + 1
 		if lh - rh < 2 {
-			return
+{{- if .Augmented}}
+			tr.reaugment()
+{{- end}}
+			return tr.n.{{.LinkN}}.height != h
 		}
 		child := &tr.n.{{.LinkN}}.nodes[0]
 		if child.n.{{.LinkN}}.nodes[0].height() < child.n.{{.LinkN}}.nodes[1].height() {
 			pivot := child.n.{{.LinkN}}.nodes[1].n
 			child.n.{{.LinkN}}.nodes[1].n = pivot.{{.LinkN}}.nodes[0].n
 			pivot.{{.LinkN}}.nodes[0].n = child.n
+{{- if .Parent}}
+			child.n.{{.LinkN}}.nodes[1].setParent(child.n)
+			pivot.{{.LinkN}}.parent = tr.n
+			child.n.{{.LinkN}}.parent = pivot
+{{- end}}
 			pivot.{{.LinkN}}.nodes[0].reheight()
 			child.n = pivot
 			child.reheight()
@@ -216,19 +696,32 @@ func (tr *{{.TreeT}}) rebalance() {
 		pivot := child.n
 		tr.n.{{.LinkN}}.nodes[0].n = pivot.{{.LinkN}}.nodes[1].n
 		pivot.{{.LinkN}}.nodes[1].n = tr.n
+{{- if .Parent}}
+		tr.n.{{.LinkN}}.nodes[0].setParent(tr.n)
+		pivot.{{.LinkN}}.parent = tr.n.{{.LinkN}}.parent
+		tr.n.{{.LinkN}}.parent = pivot
+{{- end}}
 		pivot.{{.LinkN}}.nodes[1].reheight()
 		tr.n = pivot
 		tr.reheight()
 	} else {
 		tr.n.{{.LinkN}}.height = rh + 1
 		if rh - lh < 2 {
-			return
+{{- if .Augmented}}
+			tr.reaugment()
+{{- end}}
+			return tr.n.{{.LinkN}}.height != h
 		}
 		child := &tr.n.{{.LinkN}}.nodes[1]
 		if child.n.{{.LinkN}}.nodes[1].height() < child.n.{{.LinkN}}.nodes[0].height() {
 			pivot := child.n.{{.LinkN}}.nodes[0].n
 			child.n.{{.LinkN}}.nodes[0].n = pivot.{{.LinkN}}.nodes[1].n
 			pivot.{{.LinkN}}.nodes[1].n = child.n
+{{- if .Parent}}
+			child.n.{{.LinkN}}.nodes[0].setParent(child.n)
+			pivot.{{.LinkN}}.parent = tr.n
+			child.n.{{.LinkN}}.parent = pivot
+{{- end}}
 			pivot.{{.LinkN}}.nodes[1].reheight()
 			child.n = pivot
 			child.reheight()
@@ -236,206 +729,781 @@ func (tr *{{.TreeT}}) rebalance() {
 		pivot := child.n
 		tr.n.{{.LinkN}}.nodes[1].n = pivot.{{.LinkN}}.nodes[0].n
 		pivot.{{.LinkN}}.nodes[0].n = tr.n
+{{- if .Parent}}
+		tr.n.{{.LinkN}}.nodes[1].setParent(tr.n)
+		pivot.{{.LinkN}}.parent = tr.n.{{.LinkN}}.parent
+		tr.n.{{.LinkN}}.parent = pivot
+{{- end}}
 		pivot.{{.LinkN}}.nodes[0].reheight()
 		tr.n = pivot
 		tr.reheight()
 	}
+	return tr.n.{{.LinkN}}.height != h
+}
+
+// Helper function, don't use.
+// Rebalance the trees in the path (where something was inserted or
+// removed under the last one) from the bottom up. The receiver
+// doesn't matter.
+func (tr *{{.TreeT}}) rebalancePath(path []*{{.TreeT}}) {
+	for i := len(path) - 1; i >= 0; i-- {
+		if !path[i].rebalance() {
+			/*
+			 * The height didn't change so nothing further
+			 * up needs to be rebalanced.
+			 */
+{{- if .Augmented}}
+			// But what the links know about the subtrees
+			// still changes.
+			for i--; i >= 0; i-- {
+				path[i].reaugment()
+			}
+{{- end}}
+			return
+		}
+	}
 }
 {{- if .F.insert}}
+{{- if eq .Dups "reject"}}
+
+// Returns false if an equal element is already in the tree.
+func (tr *{{.TreeT}}) {{.F.insert}}(x *{{.NodeT}}) bool {
+{{- else if eq .Dups "replace"}}
+
+// Returns the element that x replaced, nil if there was none.
+func (tr *{{.TreeT}}) {{.F.insert}}(x *{{.NodeT}}) *{{.NodeT}} {
+{{- else}}
 
 func (tr *{{.TreeT}}) {{.F.insert}}(x *{{.NodeT}}) {
+{{- end}}
 	path := [64]*{{.TreeT}}{}
 	depth := 0
 	for tr.n != nil {
 		path[depth] = tr
 		depth++
+{{- if eq .Dups "allow"}}
 		_, less := tr.n.{{.CmpF}}(x)
 		/*
-		 * We need to decide how to handle equality.
-		 *
-		 * Four options:
-		 * 1. Silently assume it doesn't happen, just insert
-		 *    duplicate elements. It's your foot and your
-		 *    trigger. (current choice)
-		 * 2. Silently ignore and don't insert.
-		 * 3. Refuse to insert, return boolean for success.
-		 * 4. Replace, return old element.
+		 * Equal elements are silently inserted as duplicates.
+		 * It's your foot and your trigger. The "dups" option
+		 * in the tag changes this.
 		 */
+{{- else}}
+		eq, less := tr.n.{{.CmpF}}(x)
+		if eq {
+{{- if eq .Dups "ignore"}}
+			return
+{{- else if eq .Dups "reject"}}
+			return false
+{{- else}}
+			/*
+			 * x takes over the position of the old
+			 * element. Nothing changes shape so no
+			 * rebalancing necessary.
+			 */
+			old := tr.n
+			x.{{.LinkN}} = old.{{.LinkN}}
+			tr.n = x
+{{- if .Parent}}
+			x.{{.LinkN}}.nodes[0].setParent(x)
+			x.{{.LinkN}}.nodes[1].setParent(x)
+{{- end}}
+{{- if or .Augment .IvStart}}
+			// But x isn't old, everything above it needs
+			// to be recomputed.
+			for i := depth - 1; i >= 0; i-- {
+				path[i].reaugment()
+			}
+{{- end}}
+			// old isn't in the tree anymore and must not
+			// look like it.
+			old.{{.LinkN}} = {{.LinkT}}{}
+			return old
+{{- end}}
+		}
+{{- end}}
 		tr = &tr.n.{{.LinkN}}.nodes[btoi(!less)]
 	}
 	x.{{.LinkN}}.nodes[0].n = nil
 	x.{{.LinkN}}.nodes[1].n = nil
 	x.{{.LinkN}}.height = 1
+{{- if .Parent}}
+	x.{{.LinkN}}.parent = nil
+	if depth > 0 {
+		x.{{.LinkN}}.parent = path[depth-1].n
+	}
+{{- end}}
 	tr.n = x
+{{- if .Augmented}}
+	tr.reaugment()
+{{- end}}
 
-	for i := depth - 1; i >= 0; i-- {
-		path[i].rebalance()
-	}
+	tr.rebalancePath(path[:depth])
+{{- if eq .Dups "reject"}}
+	return true
+{{- else if eq .Dups "replace"}}
+	return nil
+{{- end}}
 }
 {{- end -}}
-{{- if .F.delete}}
+{{- if or .F.delete (and .CmpVals .F.deleteVal)}}
 
-func (tr *{{.TreeT}}) {{.F.delete}}(x *{{.NodeT}}) {
-	/*
-	 * We silently ignore deletions of elements that are
-	 * not in the tree. The options here are to return
-	 * something or panic or do nothing. All three equally
-	 * valid.
-	 */
-	if tr.n == nil {
-		return
+// Helper function, don't use.
+// Remove the element in the last tree of the path and rebalance
+// the path. path[0] must be the root of the tree.
+func (tr *{{.TreeT}}) remove(path []*{{.TreeT}}) {
+	t := path[len(path)-1]
+	x := t.n
+	if x.{{.LinkN}}.nodes[0].n == nil || x.{{.LinkN}}.nodes[1].n == nil {
+		t.n = x.{{.LinkN}}.nodes[btoi(x.{{.LinkN}}.nodes[0].n == nil)].n
+{{- if .Parent}}
+		t.setParent(x.{{.LinkN}}.parent)
+{{- end}}
+		path = path[:len(path)-1]
+	} else {
+		/*
+		 * Replace x with the first element of the
+		 * nodes[0] subtree. Remember the path to it
+		 * because everything on the way needs to be
+		 * rebalanced.
+		 */
+		d := len(path)
+		nt := &x.{{.LinkN}}.nodes[0]
+		for nt.n.{{.LinkN}}.nodes[1].n != nil {
+			path = append(path, nt)
+			nt = &nt.n.{{.LinkN}}.nodes[1]
+		}
+		next := nt.n
+		nt.n = next.{{.LinkN}}.nodes[0].n
+{{- if .Parent}}
+		if len(path) > d {
+			nt.setParent(path[len(path)-1].n)
+		}
+{{- end}}
+		next.{{.LinkN}} = x.{{.LinkN}}
+		t.n = next
+{{- if .Parent}}
+		next.{{.LinkN}}.nodes[0].setParent(next)
+		next.{{.LinkN}}.nodes[1].setParent(next)
+{{- end}}
+		if len(path) > d {
+			// This pointed into the link of x.
+			path[d] = &next.{{.LinkN}}.nodes[0]
+		}
 	}
+{{- if .Parent}}
+	// Removed elements must not look like they're in a tree.
+	x.{{.LinkN}} = {{.LinkT}}{}
+{{- end}}
 
-	if tr.n == x {
-		if tr.n.{{.LinkN}}.nodes[0].n == nil {
-			tr.n = tr.n.{{.LinkN}}.nodes[1].n
-		} else if tr.n.{{.LinkN}}.nodes[1].n == nil {
-			tr.n = tr.n.{{.LinkN}}.nodes[0].n
-		} else {
-			next := tr.n.{{.LinkN}}.nodes[0].{{.F.first}}()
-			tr.n.{{.LinkN}}.nodes[0].{{.F.delete}}(next)
-			next.{{.LinkN}} = tr.n.{{.LinkN}}
-			tr.n = next
-			tr.rebalance()
+	tr.rebalancePath(path)
+}
+{{- end -}}
+{{- if .Parent}}
+
+// Helper function, don't use.
+// Return the element next to x in the direction of nodes[d],
+// found by following the parent pointers.
+func (tr *{{.TreeT}}) step(x *{{.NodeT}}, d int) *{{.NodeT}} {
+	if n := x.{{.LinkN}}.nodes[d].n; n != nil {
+		for n.{{.LinkN}}.nodes[d^1].n != nil {
+			n = n.{{.LinkN}}.nodes[d^1].n
 		}
-	} else {
-		_, less := tr.n.{{.CmpF}}(x)
-		tr.n.{{.LinkN}}.nodes[btoi(!less)].{{.F.delete}}(x)
-		tr.rebalance()
+		return n
 	}
+	for p := x.{{.LinkN}}.parent; p != nil; x, p = p, p.{{.LinkN}}.parent {
+		if p.{{.LinkN}}.nodes[d].n != x {
+			return p
+		}
+	}
+	return nil
 }
 {{- end -}}
-{{- if .F.lookup}}
+{{- if .F.buildSorted}}
 
-func (tr *{{.TreeT}}) {{.F.lookup}}(x *{{.NodeT}}) *{{.NodeT}} {
-	n := tr.n
+// Replace the contents of the tree with the elements in nodes which
+// must already be sorted. The tree is built perfectly balanced
+// without comparing or rotating anything.
+func (tr *{{.TreeT}}) {{.F.buildSorted}}(nodes []*{{.NodeT}}) {
+{{- if .Parent}}
+	// The old elements must not look like they are still in the
+	// tree. The ones in nodes get new links anyway.
+	tr.drop(true)
+{{- end}}
+	tr.build(nodes)
+}
 
-	for n != nil {
-		eq, less := n.{{.CmpF}}(x)
-		if eq {
+// Helper function, don't use.
+// Build the tree from nodes ignoring the old links of the tree and
+// the nodes.
+func (tr *{{.TreeT}}) build(nodes []*{{.NodeT}}) {
+	if len(nodes) == 0 {
+		tr.n = nil
+		return
+	}
+	m := len(nodes) / 2
+	tr.n = nodes[m]
+	tr.n.{{.LinkN}}.nodes[1].build(nodes[:m])
+	tr.n.{{.LinkN}}.nodes[0].build(nodes[m+1:])
+	tr.reheight()
+{{- if .Parent}}
+	tr.n.{{.LinkN}}.parent = nil
+	tr.n.{{.LinkN}}.nodes[0].setParent(tr.n)
+	tr.n.{{.LinkN}}.nodes[1].setParent(tr.n)
+{{- end}}
+}
+{{- end -}}
+{{- if or (and .F.join .F.concat) .F.popFirst .F.popLast}}
+
+// Helper function, don't use.
+// Remove and return the element at the edge of the tree in the
+// direction of nodes[d].
+func (tr *{{.TreeT}}) pop(d int) *{{.NodeT}} {
+	if tr.n == nil {
+		return nil
+	}
+	path := [64]*{{.TreeT}}{}
+	depth := 0
+	for {
+		path[depth] = tr
+		depth++
+		if tr.n.{{.LinkN}}.nodes[d].n == nil {
 			break
 		}
-		n = n.{{.LinkN}}.nodes[btoi(!less)].n
+		tr = &tr.n.{{.LinkN}}.nodes[d]
 	}
-	return n
+	x := tr.n
+	tr.n = x.{{.LinkN}}.nodes[d^1].n
+{{- if .Parent}}
+	tr.setParent(x.{{.LinkN}}.parent)
+	x.{{.LinkN}} = {{.LinkT}}{}
+{{- end}}
+	tr.rebalancePath(path[:depth-1])
+	return x
 }
 {{- end -}}
-{{- if .F.last}}
+{{- if .F.popFirst}}
 
-func (tr *{{.TreeT}}) {{.F.last}}() (ret *{{.NodeT}}) {
-	for n := tr.n; n != nil; n = n.{{.LinkN}}.nodes[0].n {
-		ret = n
-	}
-	return
+// Remove and return the first element, nil if the tree is empty.
+// Cheaper than first and delete since it only descends once and
+// doesn't compare anything.
+func (tr *{{.TreeT}}) {{.F.popFirst}}() *{{.NodeT}} {
+	return tr.pop(1)
 }
 {{- end -}}
-{{- if .F.first}}
+{{- if .F.popLast}}
 
-func (tr *{{.TreeT}}) {{.F.first}}() (ret *{{.NodeT}}) {
-	for n := tr.n; n != nil; n = n.{{.LinkN}}.nodes[1].n {
-		ret = n
-	}
-	return
+// Remove and return the last element, nil if the tree is empty.
+func (tr *{{.TreeT}}) {{.F.popLast}}() *{{.NodeT}} {
+	return tr.pop(0)
 }
 {{- end -}}
-{{- if .CmpVal -}}
-{{- if .F.lookupVal}}
+{{- if .F.join}}
 
-func (tr *{{.TreeT}}) {{.F.lookupVal}}(x {{.CmpValType}}) *{{.NodeT}} {
-	n := tr.n
-	for n != nil {
-		eq, less := n.{{.CmpVal}}(x)
-		if eq {
-			break
-		}
-		n = n.{{.LinkN}}.nodes[btoi(!less)].n
+// Make the tree the concatenation of l, mid and r. All elements in
+// l must be before mid and all elements in r after mid. l and r are
+// consumed. O(log n).
+func (tr *{{.TreeT}}) {{.F.join}}(l {{.TreeT}}, mid *{{.NodeT}}, r {{.TreeT}}) {
+{{- if .Parent}}
+	tr.forget(l, r)
+{{- end}}
+	lh, rh := l.height(), r.height()
+	if lh > rh+1 {
+		// Walk down the edge of the taller tree until it's
+		// short enough to be the sibling of the other tree.
+		tr.n = l.n
+		tr.n.{{.LinkN}}.nodes[0].{{.F.join}}(tr.n.{{.LinkN}}.nodes[0], mid, r)
+{{- if .Parent}}
+		tr.n.{{.LinkN}}.nodes[0].setParent(tr.n)
+{{- end}}
+		tr.rebalance()
+	} else if rh > lh+1 {
+		tr.n = r.n
+		tr.n.{{.LinkN}}.nodes[1].{{.F.join}}(l, mid, tr.n.{{.LinkN}}.nodes[1])
+{{- if .Parent}}
+		tr.n.{{.LinkN}}.nodes[1].setParent(tr.n)
+{{- end}}
+		tr.rebalance()
+	} else {
+		mid.{{.LinkN}}.nodes[0] = r
+		mid.{{.LinkN}}.nodes[1] = l
+		tr.n = mid
+		tr.reheight()
+{{- if .Parent}}
+		mid.{{.LinkN}}.nodes[0].setParent(mid)
+		mid.{{.LinkN}}.nodes[1].setParent(mid)
+{{- end}}
 	}
-	return n
+{{- if .Parent}}
+	tr.n.{{.LinkN}}.parent = nil
+{{- end}}
 }
 {{- end -}}
-{{- if .F.searchValGEQ}}
+{{- if and .F.join .F.concat}}
 
-// Find nearest value greater than or equal to x
-func (tr *{{.TreeT}}) {{.F.searchValGEQ}}(x {{.CmpValType}}) *{{.NodeT}} {
-	// Empty tree can't match.
-	if tr.n == nil {
-		return nil
-	}
-	eq, less := tr.n.{{.CmpVal}}(x)
-	if eq {
-		return tr.n
+// Make the tree the concatenation of l and r. All elements in l
+// must be before the elements in r. l and r are consumed.
+func (tr *{{.TreeT}}) {{.F.concat}}(l, r {{.TreeT}}) {
+{{- if .Parent}}
+	tr.forget(l, r)
+{{- end}}
+	if r.n == nil {
+		tr.n = l.n
+{{- if .Parent}}
+		tr.setParent(nil)
+{{- end}}
+		return
 	}
-	if !less {
-		l := tr.n.{{.LinkN}}.nodes[1].{{.F.searchValGEQ}}(x)
-		if l != nil {
-			_, less := tr.n.{{.CmpF}}(l)
-			if !less {
-				return l
-			}
-		}
-		return tr.n
+	mid := r.pop(1)
+	tr.{{.F.join}}(l, mid, r)
+}
+{{- end -}}
+{{- if and .Parent .F.join}}
+
+// Helper function, don't use.
+// Forget the old contents of the tree before it's made from l and r.
+// Unless the tree is l or r, its elements have their links zeroed so
+// that they don't look like they are still in a tree.
+func (tr *{{.TreeT}}) forget(l, r {{.TreeT}}) {
+	if tr.n != l.n && tr.n != r.n {
+		tr.drop(true)
 	}
-	return tr.n.{{.LinkN}}.nodes[0].{{.F.searchValGEQ}}(x)
+	tr.n = nil
 }
 {{- end -}}
-{{- if .F.searchValLEQ}}
+{{- if or .F.clear (and .Parent (or .F.buildSorted .F.join)) (and .F.join .F.concat (or (and .Parent .F.intersection) (and .CmpVals .F.deleteRangeVal)))}}
 
-// Find nearest value less than or equal to x
-func (tr *{{.TreeT}}) {{.F.searchValLEQ}}(x {{.CmpValType}}) *{{.NodeT}} {
-	// Empty tree can't match.
+// Helper function, don't use.
+// Empty the tree and return how many elements it had. If unlink the
+// links of the elements are zeroed.
+func (tr *{{.TreeT}}) drop(unlink bool) int {
+{{- if .Size}}
+	if !unlink {
+		c := tr.size()
+		tr.n = nil
+		return c
+	}
+{{- end}}
 	if tr.n == nil {
-		return nil
+		return 0
 	}
-	eq, less := tr.n.{{.CmpVal}}(x)
-	if eq {
-		return tr.n
+	l, r := tr.n.{{.LinkN}}.nodes[0], tr.n.{{.LinkN}}.nodes[1]
+	if unlink {
+		tr.n.{{.LinkN}} = {{.LinkT}}{}
 	}
-	if less {
-		l := tr.n.{{.LinkN}}.nodes[0].{{.F.searchValLEQ}}(x)
-		if l != nil {
-			_, less := tr.n.{{.CmpF}}(l)
-			if less {
-				return l
-			}
-		}
-		return tr.n
+	tr.n = nil
+	return l.drop(unlink) + r.drop(unlink) + 1
+}
+{{- end -}}
+{{- if .F.clear}}
+
+// Empty the tree. If unlink, the links of all elements are zeroed
+// so that they don't keep each other reachable and can safely be
+// inserted into other trees. That's O(n), otherwise clear is O(1).
+{{- if .Parent}}
+// The links are always zeroed since delete depends on elements
+// that aren't in the tree having zeroed links.
+{{- end}}
+func (tr *{{.TreeT}}) {{.F.clear}}(unlink bool) {
+{{- if .Parent}}
+	tr.drop(true)
+{{- else}}
+	if unlink {
+		tr.drop(true)
 	}
-	return tr.n.{{.LinkN}}.nodes[1].{{.F.searchValLEQ}}(x)
+	tr.n = nil
+{{- end}}
 }
 {{- end -}}
-{{- if .F.deleteVal}}
+{{- if and .F.join .F.concat (or .F.union .F.intersection .F.difference)}}
 
-func (tr *{{.TreeT}}) {{.F.deleteVal}}(x {{.CmpValType}}) {
-	/*
-	 * We silently ignore deletions of elements that are
+// Helper function, don't use.
+// Split the tree into the elements before x, the elements after x
+// and the element equal to x. The tree is empty afterwards.
+func (tr *{{.TreeT}}) splitNode(x *{{.NodeT}}) (lt, gt {{.TreeT}}, eq *{{.NodeT}}) {
+	n := tr.n
+	if n == nil {
+		return
+	}
+	tr.n = nil
+	l, r := n.{{.LinkN}}.nodes[1], n.{{.LinkN}}.nodes[0]
+	e, less := n.{{.CmpF}}(x)
+	if e {
+{{- if .Parent}}
+		l.setParent(nil)
+		r.setParent(nil)
+{{- end}}
+		return l, r, n
+	}
+	if less {
+		var rl {{.TreeT}}
+		rl, gt, eq = r.splitNode(x)
+		lt.{{.F.join}}(l, n, rl)
+	} else {
+		var lg {{.TreeT}}
+		lt, lg, eq = l.splitNode(x)
+		gt.{{.F.join}}(lg, n, r)
+	}
+	return
+}
+
+// Helper function, don't use.
+// Pick which of the two equal elements a (from the tree) and b (from
+// the other tree) survives.
+func (tr *{{.TreeT}}) pick(a, b *{{.NodeT}}, conflict func(a, b *{{.NodeT}}) *{{.NodeT}}) *{{.NodeT}} {
+	w := a
+	if conflict != nil {
+		w = conflict(a, b)
+	}
+{{- if .Parent}}
+	if w == a {
+		b.{{.LinkN}} = {{.LinkT}}{}
+	} else {
+		a.{{.LinkN}} = {{.LinkT}}{}
+	}
+{{- end}}
+	return w
+}
+{{- end -}}
+{{- if and .F.join .F.concat .F.union}}
+
+// Helper function, don't use.
+func (tr *{{.TreeT}}) unionOf(a, b {{.TreeT}}, conflict func(a, b *{{.NodeT}}) *{{.NodeT}}) {
+	if a.n == nil || b.n == nil {
+		tr.n = a.n
+		if b.n != nil {
+			tr.n = b.n
+		}
+{{- if .Parent}}
+		tr.setParent(nil)
+{{- end}}
+		return
+	}
+	k := b.n
+	bl, br := k.{{.LinkN}}.nodes[1], k.{{.LinkN}}.nodes[0]
+	al, ar, eq := a.splitNode(k)
+	var l, r {{.TreeT}}
+	l.unionOf(al, bl, conflict)
+	r.unionOf(ar, br, conflict)
+	if eq != nil {
+		k = tr.pick(eq, k, conflict)
+	}
+	tr.{{.F.join}}(l, k, r)
+}
+
+// Move all elements of o into the tree, o is empty afterwards. When
+// both trees have an equal element conflict decides which one of
+// them stays, the other one is dropped. If conflict is nil the
+// element from this tree stays.
+func (tr *{{.TreeT}}) {{.F.union}}(o *{{.TreeT}}, conflict func(a, b *{{.NodeT}}) *{{.NodeT}}) {
+	a, b := *tr, *o
+	o.n = nil
+	tr.unionOf(a, b, conflict)
+}
+{{- end -}}
+{{- if and .F.join .F.concat .F.intersection}}
+
+// Helper function, don't use.
+func (tr *{{.TreeT}}) intersectionOf(a, b {{.TreeT}}, conflict func(a, b *{{.NodeT}}) *{{.NodeT}}) {
+	if a.n == nil || b.n == nil {
+{{- if .Parent}}
+		a.drop(true)
+		b.drop(true)
+{{- end}}
+		tr.n = nil
+		return
+	}
+	k := b.n
+	bl, br := k.{{.LinkN}}.nodes[1], k.{{.LinkN}}.nodes[0]
+	al, ar, eq := a.splitNode(k)
+	var l, r {{.TreeT}}
+	l.intersectionOf(al, bl, conflict)
+	r.intersectionOf(ar, br, conflict)
+	if eq != nil {
+		tr.{{.F.join}}(l, tr.pick(eq, k, conflict), r)
+	} else {
+{{- if .Parent}}
+		k.{{.LinkN}} = {{.LinkT}}{}
+{{- end}}
+		tr.{{.F.concat}}(l, r)
+	}
+}
+
+// Keep only the elements that are in both trees, o is empty
+// afterwards. conflict decides which one of the two equal elements
+// stays, if it is nil the element from this tree stays.
+func (tr *{{.TreeT}}) {{.F.intersection}}(o *{{.TreeT}}, conflict func(a, b *{{.NodeT}}) *{{.NodeT}}) {
+	a, b := *tr, *o
+	o.n = nil
+	tr.intersectionOf(a, b, conflict)
+}
+{{- end -}}
+{{- if and .F.join .F.concat .F.difference}}
+
+// Helper function, don't use.
+func (tr *{{.TreeT}}) differenceOf(a, b {{.TreeT}}) {
+	if a.n == nil || b.n == nil {
+		tr.n = a.n
+{{- if .Parent}}
+		tr.setParent(nil)
+{{- end}}
+		return
+	}
+	k := b.n
+{{- if .Parent}}
+	al, ar, eq := a.splitNode(k)
+{{- else}}
+	// The equal element (if any) is just dropped.
+	al, ar, _ := a.splitNode(k)
+{{- end}}
+	var l, r {{.TreeT}}
+	l.differenceOf(al, k.{{.LinkN}}.nodes[1])
+	r.differenceOf(ar, k.{{.LinkN}}.nodes[0])
+{{- if .Parent}}
+	if eq != nil {
+		eq.{{.LinkN}} = {{.LinkT}}{}
+	}
+{{- end}}
+	tr.{{.F.concat}}(l, r)
+}
+
+// Remove all elements that have an equal element in o from the
+// tree. o is not modified.
+func (tr *{{.TreeT}}) {{.F.difference}}(o *{{.TreeT}}) {
+	a := *tr
+	tr.differenceOf(a, *o)
+}
+{{- end -}}
+{{- if .F.delete}}
+
+func (tr *{{.TreeT}}) {{.F.delete}}(x *{{.NodeT}}) {
+	/*
+	 * We silently ignore deletions of elements that are
 	 * not in the tree. The options here are to return
 	 * something or panic or do nothing. All three equally
 	 * valid.
 	 */
-	if tr.n == nil {
+{{- if .Parent}}
+	/*
+	 * No need to search for x, the parent pointers lead
+	 * us to the root. If we don't end up at our root x
+	 * is not in this tree.
+	 */
+	depth := 0
+	r := x
+	for r.{{.LinkN}}.parent != nil {
+		r = r.{{.LinkN}}.parent
+		depth++
+	}
+	if r != tr.n {
 		return
 	}
+	path := [64]*{{.TreeT}}{}
+	path[0] = tr
+	for i, n := depth, x; i > 0; i-- {
+		p := n.{{.LinkN}}.parent
+		path[i] = &p.{{.LinkN}}.nodes[btoi(p.{{.LinkN}}.nodes[1].n == n)]
+		n = p
+	}
+	tr.remove(path[:depth+1])
+{{- else}}
+	path := [64]*{{.TreeT}}{}
+	depth := 0
+	for t := tr; t.n != nil; {
+		path[depth] = t
+		depth++
+		if t.n == x {
+			tr.remove(path[:depth])
+			return
+		}
+		_, less := t.n.{{.CmpF}}(x)
+		t = &t.n.{{.LinkN}}.nodes[btoi(!less)]
+	}
+{{- end}}
+}
+{{- end -}}
+{{- if .F.lookup}}
+
+func (tr *{{.TreeT}}) {{.F.lookup}}(x *{{.NodeT}}) *{{.NodeT}} {
+	n := tr.n
+
+	for n != nil {
+		eq, less := n.{{.CmpF}}(x)
+		if eq {
+			break
+		}
+		n = n.{{.LinkN}}.nodes[btoi(!less)].n
+	}
+	return n
+}
+{{- end -}}
+{{- if .F.last}}
+
+func (tr *{{.TreeT}}) {{.F.last}}() (ret *{{.NodeT}}) {
+	for n := tr.n; n != nil; n = n.{{.LinkN}}.nodes[0].n {
+		ret = n
+	}
+	return
+}
+{{- end -}}
+{{- if .F.first}}
+
+func (tr *{{.TreeT}}) {{.F.first}}() (ret *{{.NodeT}}) {
+	for n := tr.n; n != nil; n = n.{{.LinkN}}.nodes[1].n {
+		ret = n
+	}
+	return
+}
+{{- end -}}
+{{- if not .Parent}}
+
+// Helper function, don't use.
+// Return the element next to x in the direction of nodes[d],
+// found by searching for x from the root.
+func (tr *{{.TreeT}}) step(x *{{.NodeT}}, d int) *{{.NodeT}} {
+	var ret *{{.NodeT}}
+	n := tr.n
+	for n != nil && n != x {
+		_, less := n.{{.CmpF}}(x)
+		i := btoi(!less)
+		if i != d {
+			ret = n
+		}
+		n = n.{{.LinkN}}.nodes[i].n
+	}
+	if n == nil {
+		return nil
+	}
+	if n = n.{{.LinkN}}.nodes[d].n; n != nil {
+		for n.{{.LinkN}}.nodes[d^1].n != nil {
+			n = n.{{.LinkN}}.nodes[d^1].n
+		}
+		return n
+	}
+	return ret
+}
+{{- end -}}
+{{- if .F.next}}
+
+// Return the element after x, nil if x is the last element or not
+// in the tree.
+func (tr *{{.TreeT}}) {{.F.next}}(x *{{.NodeT}}) *{{.NodeT}} {
+	return tr.step(x, 0)
+}
+{{- end -}}
+{{- if .F.prev}}
+
+// Return the element before x, nil if x is the first element or not
+// in the tree.
+func (tr *{{.TreeT}}) {{.F.prev}}(x *{{.NodeT}}) *{{.NodeT}} {
+	return tr.step(x, 1)
+}
+{{- end -}}
+{{- if or .F.floor .F.ceiling .F.lower .F.higher}}
+
+// Helper function, don't use.
+// Find the element nearest to x in the direction of nodes[d], or an
+// element equal to x unless strict.
+func (tr *{{.TreeT}}) near(x *{{.NodeT}}, d int, strict bool) *{{.NodeT}} {
+	var r *{{.NodeT}}
+	n := tr.n
+	for n != nil {
+		eq, less := n.{{.CmpF}}(x)
+		if eq && !strict {
+			return n
+		}
+		if d == 0 && !eq && !less || d == 1 && less {
+			// n is on the right side of x, but there might
+			// be something closer.
+			r = n
+			n = n.{{.LinkN}}.nodes[d^1].n
+		} else {
+			n = n.{{.LinkN}}.nodes[d].n
+		}
+	}
+	return r
+}
+{{- end -}}
+{{- if .F.ceiling}}
 
-	eq, more := tr.n.{{.CmpVal}}(x)
-	if eq {
-		if tr.n.{{.LinkN}}.nodes[0].n == nil {
-			tr.n = tr.n.{{.LinkN}}.nodes[1].n
-		} else if tr.n.{{.LinkN}}.nodes[1].n == nil {
-			tr.n = tr.n.{{.LinkN}}.nodes[0].n
+// Return the {{if .Desc}}greatest element less{{else}}least element greater{{end}} than or equal to x, nil if
+// there is none.
+func (tr *{{.TreeT}}) {{.F.ceiling}}(x *{{.NodeT}}) *{{.NodeT}} {
+	return tr.near(x, 0, false)
+}
+{{- end -}}
+{{- if .F.higher}}
+
+// Return the {{if .Desc}}greatest element less{{else}}least element greater{{end}} than x, nil if there is
+// none.
+func (tr *{{.TreeT}}) {{.F.higher}}(x *{{.NodeT}}) *{{.NodeT}} {
+	return tr.near(x, 0, true)
+}
+{{- end -}}
+{{- if .F.floor}}
+
+// Return the {{if .Desc}}least element greater{{else}}greatest element less{{end}} than or equal to x, nil if
+// there is none.
+func (tr *{{.TreeT}}) {{.F.floor}}(x *{{.NodeT}}) *{{.NodeT}} {
+	return tr.near(x, 1, false)
+}
+{{- end -}}
+{{- if .F.lower}}
+
+// Return the {{if .Desc}}least element greater{{else}}greatest element less{{end}} than x, nil if there is
+// none.
+func (tr *{{.TreeT}}) {{.F.lower}}(x *{{.NodeT}}) *{{.NodeT}} {
+	return tr.near(x, 1, true)
+}
+{{- end -}}
+{{- if .F.len}}
+
+// Return the number of elements in the tree.
+func (tr *{{.TreeT}}) {{.F.len}}() int {
+	return tr.size()
+}
+{{- end -}}
+{{- if .F.nth}}
+
+// Return the i:th element (counting from 0) in the tree,
+// nil if there aren't that many elements.
+func (tr *{{.TreeT}}) {{.F.nth}}(i int) *{{.NodeT}} {
+	n := tr.n
+	for n != nil {
+		l := n.{{.LinkN}}.nodes[1].size()
+		if i < l {
+			n = n.{{.LinkN}}.nodes[1].n
+		} else if i > l {
+			i -= l + 1
+			n = n.{{.LinkN}}.nodes[0].n
 		} else {
-			next := tr.n.{{.LinkN}}.nodes[0].{{.F.first}}()
-			tr.n.{{.LinkN}}.nodes[0].{{.F.delete}}(next)
-			next.{{.LinkN}} = tr.n.{{.LinkN}}
-			tr.n = next
-			tr.rebalance()
+			break
 		}
-	} else {
-		tr.n.{{.LinkN}}.nodes[btoi(!more)].{{.F.deleteVal}}(x)
-		tr.rebalance()
 	}
+	return n
 }
 {{- end -}}
+{{- if .F.rank}}
+
+// Return the position of x in the tree (the number of elements
+// before it), -1 if x is not in the tree.
+func (tr *{{.TreeT}}) {{.F.rank}}(x *{{.NodeT}}) int {
+	r := 0
+	n := tr.n
+	for n != nil {
+		if n == x {
+			return r + n.{{.LinkN}}.nodes[1].size()
+		}
+		_, less := n.{{.CmpF}}(x)
+		if less {
+			r += n.{{.LinkN}}.nodes[1].size() + 1
+		}
+		n = n.{{.LinkN}}.nodes[btoi(!less)].n
+	}
+	return -1
+}
 {{- end -}}
+{{- range .CmpVals}}{{template "cmpval" .}}{{end -}}
 {{- if .IterT}}
 
 type {{.IterT}} struct {
@@ -443,18 +1511,33 @@ type {{.IterT}} struct {
 	start, end *{{.NodeT}}
 	// Should start and end elements be included in the iteration?
 	incs, ince, rev bool
+	// ince as it was before next consumed it, for seek.
+	incEnd bool
+	// Was start returned by next?
+	cur bool
+	// The tree we iterate over.
+	tr *{{.TreeT}}
+{{- if not .Parent}}
 	// The path we took to reach the previous element.
 	path []*{{.TreeT}}
+{{- end}}
 }
 {{- if .F.iter}}
 
 func (tr *{{.TreeT}}) {{.F.iter}}(start, end *{{.NodeT}}, incs, ince bool) *{{.IterT}} {
-	it := &{{.IterT}}{start: start, end: end, incs: incs, ince: ince, path: make([]*{{.TreeT}}, 0, tr.height())}
+{{- if .Parent}}
+	it := &{{.IterT}}{start: start, end: end, incs: incs, ince: ince, incEnd: ince, tr: tr}
+	if start == nil {
+		it.diveDown(tr)
+	}
+{{- else}}
+	it := &{{.IterT}}{start: start, end: end, incs: incs, ince: ince, incEnd: ince, tr: tr, path: make([]*{{.TreeT}}, 0, tr.height())}
 	if start != nil {
 		it.findStartPath(tr)
 	} else {
 		it.diveDown(tr)
 	}
+{{- end}}
 	if end == nil {
 		it.end = tr.{{.F.last}}()
 	}
@@ -469,45 +1552,18 @@ func (tr *{{.TreeT}}) {{.F.iter}}(start, end *{{.NodeT}}, incs, ince bool) *{{.I
 	return it
 }
 {{- end -}}
-{{- if .CmpVal }}
-{{- if .F.iterVal}}
-
-// start, end - start and end values of iteration.
-// edgeStart,edgeEnd - ignore start/end and start/end the iteration at the edge of the tree.
-// incs, ince - include the start/end value in the iteration.
-func (tr *{{.TreeT}}) {{.F.iterVal}}(start, end {{.CmpValType}}, edgeStart, edgeEnd, incs, ince bool) *{{.IterT}} {
-	var s, e *{{.NodeT}}
-	if !edgeStart {
-		s = tr.{{.F.searchValLEQ}}(start)
-		if eq, _ := s.{{.CmpVal}}(start); !eq {
-			// If we got a value less than start,
-			// force incs to false since we don't
-			// want to include it.
-			incs = false
-		}
-	}
-	if !edgeEnd {
-		e = tr.{{.F.searchValGEQ}}(end)
-		if eq, _ := e.{{.CmpVal}}(end); !eq {
-			// If we got a value greater than end,
-			// force ince to false since we don't
-			// want to include it.
-			ince = false
-		}
-	}
-	return tr.{{.F.iter}}(s, e, incs, ince)
-}
-{{- end -}}
-{{- end}}
 
 // Helper function, don't use.
 func (it *{{.IterT}}) diveDown(t *{{.TreeT}}) {
 	for t.n != nil {
+{{- if not .Parent}}
 		it.path = append(it.path, t)
+{{- end}}
 		it.start = t.n // lazy, should just be done once.
 		t = &t.n.{{.LinkN}}.nodes[btoi(!it.rev)]
 	}
 }
+{{- if not .Parent}}
 
 // Helper function, don't use.
 func (it *{{.IterT}}) findStartPath(t *{{.TreeT}}) {
@@ -520,56 +1576,238 @@ func (it *{{.IterT}}) findStartPath(t *{{.TreeT}}) {
 		t = &t.n.{{.LinkN}}.nodes[btoi(!less)]
 	}
 }
+{{- end}}
 
 func (it *{{.IterT}}) value() *{{.NodeT}} {
 	return it.start
 }
 
+// Helper function, don't use.
+// Move to the next element.
+func (it *{{.IterT}}) advance() {
+{{- if .Parent}}
+	// The parent pointers know the way, no path needed.
+	it.start = it.tr.step(it.start, btoi(it.rev))
+{{- else}}
+	/*
+	 * right - towards the end of iteration (0 in forward iteration)
+	 * left - towards beginning of the iteration (1 in forward iteration)
+	 *
+	 * Last returned element is it.start
+	 * We got it through t := it.path[len(it.path)-1].
+	 * if t has a tree to the right, the next element
+	 * is the leftmost element of the right tree.
+	 * If it doesn't, the next element is the one parent
+	 * we have that's bigger than us.
+	 *
+	 * We don't check for underflow of path. If that
+	 * happens something is already seriously wrong,
+	 * crashing is the best option.
+	 */
+	if it.start.{{.LinkN}}.nodes[btoi(it.rev)].n != nil {
+		it.diveDown(&it.start.{{.LinkN}}.nodes[btoi(it.rev)])
+	} else {
+		for {
+			it.path = it.path[:len(it.path)-1]
+			_, less := it.path[len(it.path)-1].n.{{.CmpF}}(it.start)
+			if less == it.rev {
+				break
+			}
+		}
+		it.start = it.path[len(it.path)-1].n
+	}
+{{- end}}
+}
+
 func (it *{{.IterT}}) next() bool {
+{{- if .Parent}}
+	if it.detached(it.start) || it.detached(it.end) {
+		it.reattach()
+	}
+{{- end}}
 	if it.start != it.end {
 		// incs can only be set for the first element of the iterator,
 		// if it is, we just don't move to the next element.
 		if it.incs {
 			it.incs = false
+			it.cur = true
 			return true
 		}
-		/*
-		 * right - towards the end of iteration (0 in forward iteration)
-		 * left - towards beginning of the iteration (1 in forward iteration)
-		 *
-		 * Last returned element is it.start
-		 * We got it through t := it.path[len(it.path)-1].
-		 * if t has a tree to the right, the next element
-		 * is the leftmost element of the right tree.
-		 * If it doesn't, the next element is the one parent
-		 * we have that's bigger than us.
-		 *
-		 * We don't check for underflow of path. If that
-		 * happens something is already seriously wrong,
-		 * crashing is the best option.
-		 */
-		if it.start.{{.LinkN}}.nodes[btoi(it.rev)].n != nil {
-			it.diveDown(&it.start.{{.LinkN}}.nodes[btoi(it.rev)])
-		} else {
-			for {
-				it.path = it.path[:len(it.path)-1]
-				_, less := it.path[len(it.path)-1].n.{{.CmpF}}(it.start)
-				if less == it.rev {
-					break
-				}
-			}
-			it.start = it.path[len(it.path)-1].n
-		}
+		it.advance()
 	}
 	if it.start != it.end {
+		it.cur = true
 		return true
 	} else if it.ince {
 		it.ince = false
-		return it.end != nil // can happen with empty iterator.
+		it.incs = false
+		it.cur = it.end != nil // can happen with empty iterator.
+		return it.cur
 	} else {
+		it.cur = false
 		return false
 	}
 }
+{{- if .Parent}}
+
+// Helper function, don't use.
+// Deleted elements have their link zeroed, so an element without a
+// parent that isn't the root is not in the tree anymore.
+func (it *{{.IterT}}) detached(n *{{.NodeT}}) bool {
+	return n != nil && n.{{.LinkN}}.parent == nil && n != it.tr.n
+}
+
+// Helper function, don't use.
+// Find the element nearest to where x was in the direction of
+// nodes[d]. Elements equal to x are skipped.
+func (it *{{.IterT}}) nearest(x *{{.NodeT}}, d int) *{{.NodeT}} {
+	var r *{{.NodeT}}
+	for n := it.tr.n; n != nil; {
+		eq, less := n.{{.CmpF}}(x)
+		if !eq && less == (d == 1) {
+			r = n
+			n = n.{{.LinkN}}.nodes[d^1].n
+		} else {
+			n = n.{{.LinkN}}.nodes[d].n
+		}
+	}
+	return r
+}
+
+// Helper function, don't use.
+// The current or the end element was deleted from the tree behind
+// our back. Continue from the elements nearest to where they were.
+func (it *{{.IterT}}) reattach() {
+	d := btoi(it.rev)
+	if it.detached(it.end) {
+		// The new end was before the old end, so it's included.
+		it.end = it.nearest(it.end, d^1)
+		it.ince = true
+		it.incEnd = true
+	}
+	if it.detached(it.start) {
+		it.start = it.nearest(it.start, d)
+		it.incs = true
+		it.cur = false
+	}
+	if it.start == nil || it.end == nil {
+		it.start, it.end = nil, nil
+		it.incs, it.ince = false, false
+	} else if eq, less := it.start.{{.CmpF}}(it.end); !eq && less == it.rev {
+		// Nothing left between start and end.
+		it.start = it.end
+		it.incs, it.ince = false, false
+	}
+}
+{{- end}}
+
+// Helper function, don't use.
+// Make n the current element.
+func (it *{{.IterT}}) moveTo(n *{{.NodeT}}) {
+	it.start = n
+	it.cur = false
+{{- if not .Parent}}
+	it.path = it.path[:0]
+	if n != nil {
+		it.findStartPath(it.tr)
+	}
+{{- end}}
+}
+
+// Helper function, don't use.
+// Set end to the edge of the tree in the direction of the iteration.
+func (it *{{.IterT}}) endAtEdge() {
+	it.end = nil
+	for n := it.tr.n; n != nil; n = n.{{.LinkN}}.nodes[btoi(it.rev)].n {
+		it.end = n
+	}
+}
+
+// Move the iterator so that the next call to next returns n. If n is
+// past the end of the iteration, the iteration is over.
+func (it *{{.IterT}}) seek(n *{{.NodeT}}) {
+	if it.end == nil {
+		// Nothing left to iterate over.
+		n = nil
+	} else if n != nil {
+		if eq, less := n.{{.CmpF}}(it.end); !eq && less == it.rev {
+			n = nil
+		}
+	}
+	if n == nil {
+		it.moveTo(it.end)
+		it.incs = false
+		it.ince = false
+		return
+	}
+	it.moveTo(n)
+	it.incs = true
+	it.ince = it.incEnd
+}
+
+// Restart the iteration from the edge of the tree and iterate over
+// all elements, backwards if rev is set.
+func (it *{{.IterT}}) reset(rev bool) {
+	it.rev = rev
+	it.endAtEdge()
+{{- if not .Parent}}
+	it.path = it.path[:0]
+{{- end}}
+	it.start = nil
+	it.diveDown(it.tr)
+	it.incs = true
+	it.ince = true
+	it.incEnd = true
+	it.cur = false
+}
+
+// Change the direction of the iteration. The iteration continues
+// from the current element towards the other edge of the tree.
+func (it *{{.IterT}}) reverse() {
+	if it.start == nil {
+		return
+	}
+	it.rev = !it.rev
+	it.endAtEdge()
+	it.incEnd = true
+	// Don't return the current element twice.
+	it.ince = it.start != it.end || it.incs
+}
+{{- if .F.delete}}
+
+// Delete the element last returned by value from the tree. The
+// iteration continues with the element after it. Does nothing if
+// next hasn't returned the current element.
+func (it *{{.IterT}}) deleteCurrent() {
+	x := it.start
+	if x == nil || !it.cur {
+		return
+	}
+	it.cur = false
+	if x == it.end {
+		// That was the last element. The one before it becomes
+		// the end so that reverse and seek have somewhere to
+		// continue from. It has been returned unless we reverse.
+		p := it.tr.step(x, btoi(!it.rev))
+		it.tr.{{.F.delete}}(x)
+		it.end = p
+		it.moveTo(p)
+		it.incs = true
+		it.ince = false
+		it.incEnd = true
+		return
+	}
+	// Move to the next element, but don't skip it in next.
+	it.advance()
+	it.incs = true
+	it.tr.{{.F.delete}}(x)
+{{- if not .Parent}}
+	// delete rearranged the tree, find the path again.
+	it.path = it.path[:0]
+	it.findStartPath(it.tr)
+{{- end}}
+}
+{{- end}}
 {{- end -}}
 {{- if .F.foreach}}
 
@@ -590,6 +1828,100 @@ func (tr *{{.TreeT}}) {{.F.foreach}}(b, m, a func(*{{.NodeT}})) {
 	}
 }
 {{- end -}}
+{{- if or .F.all .F.backward}}
+
+// Helper function, don't use.
+// Walk the tree in order towards nodes[d] until yield returns false.
+func (tr *{{.TreeT}}) walk(yield func(*{{.NodeT}}) bool, d int) bool {
+	if tr.n == nil {
+		return true
+	}
+	return tr.n.{{.LinkN}}.nodes[d^1].walk(yield, d) && yield(tr.n) && tr.n.{{.LinkN}}.nodes[d].walk(yield, d)
+}
+{{- end -}}
+{{- if .F.all}}
+
+// Iterator over all elements from first to last.
+func (tr *{{.TreeT}}) {{.F.all}}() iter.Seq[*{{.NodeT}}] {
+	return func(yield func(*{{.NodeT}}) bool) {
+		tr.walk(yield, 0)
+	}
+}
+{{- end -}}
+{{- if .F.backward}}
+
+// Iterator over all elements from last to first.
+func (tr *{{.TreeT}}) {{.F.backward}}() iter.Seq[*{{.NodeT}}] {
+	return func(yield func(*{{.NodeT}}) bool) {
+		tr.walk(yield, 1)
+	}
+}
+{{- end -}}
+{{- if and .IvStart (or .F.overlaps .F.stabbing)}}
+
+// Helper function, don't use.
+// Walk the elements that overlap [lo, hi) (or [lo, hi] if inchi) in
+// order until yield returns false.
+func (tr *{{.TreeT}}) walkOverlaps(yield func(*{{.NodeT}}) bool, lo, hi {{.IvType}}, inchi bool) bool {
+	n := tr.n
+	// Nothing in this subtree ends after lo.
+	if n == nil || !(lo < n.{{.LinkN}}.maxEnd) {
+		return true
+	}
+	if !n.{{.LinkN}}.nodes[1].walkOverlaps(yield, lo, hi, inchi) {
+		return false
+	}
+	// Neither n nor anything bigger starts before hi.
+	if !(n.{{.IvStart}} < hi || inchi && !(hi < n.{{.IvStart}})) {
+		return true
+	}
+	if lo < n.{{.IvEnd}} && !yield(n) {
+		return false
+	}
+	return n.{{.LinkN}}.nodes[0].walkOverlaps(yield, lo, hi, inchi)
+}
+{{- end -}}
+{{- if and .IvStart .F.overlaps}}
+
+// Iterator over all elements that overlap [lo, hi) ordered by start.
+func (tr *{{.TreeT}}) {{.F.overlaps}}(lo, hi {{.IvType}}) iter.Seq[*{{.NodeT}}] {
+	return func(yield func(*{{.NodeT}}) bool) {
+		tr.walkOverlaps(yield, lo, hi, false)
+	}
+}
+{{- end -}}
+{{- if and .IvStart .F.stabbing}}
+
+// Iterator over all elements that contain p ordered by start.
+func (tr *{{.TreeT}}) {{.F.stabbing}}(p {{.IvType}}) iter.Seq[*{{.NodeT}}] {
+	return func(yield func(*{{.NodeT}}) bool) {
+		tr.walkOverlaps(yield, p, p, true)
+	}
+}
+{{- end -}}
+{{- if and .IvStart .F.anyOverlap}}
+
+// Return an element that overlaps [lo, hi) or nil if there are none.
+func (tr *{{.TreeT}}) {{.F.anyOverlap}}(lo, hi {{.IvType}}) *{{.NodeT}} {
+	n := tr.n
+	for n != nil {
+		if n.{{.IvStart}} < hi && lo < n.{{.IvEnd}} {
+			return n
+		}
+		/*
+		 * If something in the smaller subtree ends after lo
+		 * and doesn't overlap, it starts at or after hi and
+		 * so does everything in the bigger subtree.
+		 */
+		if s := n.{{.LinkN}}.nodes[1].n; s != nil && lo < s.{{.LinkN}}.maxEnd {
+			n = s
+		} else {
+			n = n.{{.LinkN}}.nodes[0].n
+		}
+	}
+	return nil
+}
+{{- end -}}
 {{- if .F.check}}
 
 // This function has a bit wonky prototype, but it's
@@ -608,8 +1940,35 @@ func (tr *{{.TreeT}}) {{.F.check}}(n *{{.NodeT}}) error {
 	if eh != nh || balance < -1 || balance > 1 {
 		return fmt.Errorf("bad balance: %d %d %d, %V", nh, rh, lh, n)
 	}
+{{- if .Size}}
+	if ns, es := n.{{.LinkN}}.size, n.{{.LinkN}}.nodes[0].size()+n.{{.LinkN}}.nodes[1].size()+1; ns != es {
+		return fmt.Errorf("bad size: %d != %d, %v", ns, es, n)
+	}
+{{- end}}
+{{- if .IvStart}}
+	me := n.{{.IvEnd}}
+	for _, c := range n.{{.LinkN}}.nodes {
+		if c.n != nil && me < c.n.{{.LinkN}}.maxEnd {
+			me = c.n.{{.LinkN}}.maxEnd
+		}
+	}
+	if me != n.{{.LinkN}}.maxEnd {
+		return fmt.Errorf("bad maxEnd: %v != %v, %v", n.{{.LinkN}}.maxEnd, me, n)
+	}
+{{- end}}
 	ln := n.{{.LinkN}}.nodes[0].n
 	rn := n.{{.LinkN}}.nodes[1].n
+{{- if .Parent}}
+	if (n == tr.n) != (n.{{.LinkN}}.parent == nil) {
+		return fmt.Errorf("bad root parent %v", n)
+	}
+	if ln != nil && ln.{{.LinkN}}.parent != n {
+		return fmt.Errorf("bad parent %v", ln)
+	}
+	if rn != nil && rn.{{.LinkN}}.parent != n {
+		return fmt.Errorf("bad parent %v", rn)
+	}
+{{- end}}
 	if ln != nil {
 		_, less := ln.{{.CmpF}}(n)
 		if less {
@@ -625,4 +1984,354 @@ func (tr *{{.TreeT}}) {{.F.check}}(n *{{.NodeT}}) error {
 	return nil
 }
 {{- end}}
-`))
+{{define "cmpval"}}{{- if .F.lookupVal}}
+
+func (tr *{{.TreeT}}) {{.F.lookupVal}}({{.ValParams "x"}}) *{{.NodeT}} {
+	n := tr.n
+	for n != nil {
+		eq, less := n.{{.CmpVal}}({{.ValArgs "x"}})
+		if eq {
+			break
+		}
+		n = n.{{.LinkN}}.nodes[btoi(!less)].n
+	}
+	return n
+}
+{{- end -}}
+{{- if or .F.searchValGEQ .F.searchValLEQ .F.floorVal .F.ceilingVal .F.lowerVal .F.higherVal .IterT}}
+
+// Helper function, don't use.
+// Same as near, but for a value.
+func (tr *{{.TreeT}}) nearVal{{.Sfx}}({{.ValParams "x"}}, d int, strict bool) *{{.NodeT}} {
+	var r *{{.NodeT}}
+	n := tr.n
+	for n != nil {
+		eq, less := n.{{.CmpVal}}({{.ValArgs "x"}})
+		if eq && !strict {
+			return n
+		}
+		if d == 0 && !eq && !less || d == 1 && less {
+			r = n
+			n = n.{{.LinkN}}.nodes[d^1].n
+		} else {
+			n = n.{{.LinkN}}.nodes[d].n
+		}
+	}
+	return r
+}
+{{- end -}}
+{{- if .F.searchValGEQ}}
+
+// Find nearest value {{if .Desc}}less{{else}}greater{{end}} than or equal to x
+func (tr *{{.TreeT}}) {{.F.searchValGEQ}}({{.ValParams "x"}}) *{{.NodeT}} {
+	return tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 0, false)
+}
+{{- end -}}
+{{- if .F.searchValLEQ}}
+
+// Find nearest value {{if .Desc}}greater{{else}}less{{end}} than or equal to x
+func (tr *{{.TreeT}}) {{.F.searchValLEQ}}({{.ValParams "x"}}) *{{.NodeT}} {
+	return tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 1, false)
+}
+{{- end -}}
+{{- if .F.ceilingVal}}
+
+// Return the {{if .Desc}}greatest element less{{else}}least element greater{{end}} than or equal to x, nil if
+// there is none.
+func (tr *{{.TreeT}}) {{.F.ceilingVal}}({{.ValParams "x"}}) *{{.NodeT}} {
+	return tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 0, false)
+}
+{{- end -}}
+{{- if .F.higherVal}}
+
+// Return the {{if .Desc}}greatest element less{{else}}least element greater{{end}} than x, nil if there is
+// none.
+func (tr *{{.TreeT}}) {{.F.higherVal}}({{.ValParams "x"}}) *{{.NodeT}} {
+	return tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 0, true)
+}
+{{- end -}}
+{{- if .F.floorVal}}
+
+// Return the {{if .Desc}}least element greater{{else}}greatest element less{{end}} than or equal to x, nil if
+// there is none.
+func (tr *{{.TreeT}}) {{.F.floorVal}}({{.ValParams "x"}}) *{{.NodeT}} {
+	return tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 1, false)
+}
+{{- end -}}
+{{- if .F.lowerVal}}
+
+// Return the {{if .Desc}}least element greater{{else}}greatest element less{{end}} than x, nil if there is
+// none.
+func (tr *{{.TreeT}}) {{.F.lowerVal}}({{.ValParams "x"}}) *{{.NodeT}} {
+	return tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 1, true)
+}
+{{- end -}}
+{{- if .F.deleteVal}}
+
+func (tr *{{.TreeT}}) {{.F.deleteVal}}({{.ValParams "x"}}) {
+	/*
+	 * We silently ignore deletions of elements that are
+	 * not in the tree. The options here are to return
+	 * something or panic or do nothing. All three equally
+	 * valid.
+	 */
+	path := [64]*{{.TreeT}}{}
+	depth := 0
+	for tr.n != nil {
+		path[depth] = tr
+		depth++
+		eq, less := tr.n.{{.CmpVal}}({{.ValArgs "x"}})
+		if eq {
+			path[0].remove(path[:depth])
+			return
+		}
+		tr = &tr.n.{{.LinkN}}.nodes[btoi(!less)]
+	}
+}
+{{- end -}}
+{{- if .F.getOrInsertVal}}
+
+// Return the element equal to x. If there is none, insert the
+// element returned by mk and return it with inserted set.
+func (tr *{{.TreeT}}) {{.F.getOrInsertVal}}({{.ValParams "x"}}, mk func() *{{.NodeT}}) (n *{{.NodeT}}, inserted bool) {
+	path := [64]*{{.TreeT}}{}
+	depth := 0
+	for tr.n != nil {
+		eq, less := tr.n.{{.CmpVal}}({{.ValArgs "x"}})
+		if eq {
+			return tr.n, false
+		}
+		path[depth] = tr
+		depth++
+		tr = &tr.n.{{.LinkN}}.nodes[btoi(!less)]
+	}
+	n = mk()
+	n.{{.LinkN}}.nodes[0].n = nil
+	n.{{.LinkN}}.nodes[1].n = nil
+	n.{{.LinkN}}.height = 1
+{{- if .Parent}}
+	n.{{.LinkN}}.parent = nil
+	if depth > 0 {
+		n.{{.LinkN}}.parent = path[depth-1].n
+	}
+{{- end}}
+	tr.n = n
+{{- if .Augmented}}
+	tr.reaugment()
+{{- end}}
+
+	tr.rebalancePath(path[:depth])
+	return n, true
+}
+{{- end -}}
+{{- if and .F.join (or .F.split (and .F.concat .F.deleteRangeVal))}}
+
+// Helper function, don't use.
+// Split the tree into the elements before x (and equal to x if
+// inc) and the rest. The tree is empty afterwards.
+func (tr *{{.TreeT}}) splitVal{{.Sfx}}({{.ValParams "x"}}, inc bool) (lt, ge {{.TreeT}}) {
+	n := tr.n
+	if n == nil {
+		return
+	}
+	tr.n = nil
+	l, r := n.{{.LinkN}}.nodes[1], n.{{.LinkN}}.nodes[0]
+	if eq, less := n.{{.CmpVal}}({{.ValArgs "x"}}); less || (eq && inc) {
+		rl, rg := r.splitVal{{.Sfx}}({{.ValArgs "x"}}, inc)
+		lt.{{.F.join}}(l, n, rl)
+		ge = rg
+	} else {
+		ll, lg := l.splitVal{{.Sfx}}({{.ValArgs "x"}}, inc)
+		ge.{{.F.join}}(lg, n, r)
+		lt = ll
+	}
+	return
+}
+{{- end -}}
+{{- if and .F.split .F.join}}
+
+// Split the tree into the elements before x and the elements equal
+// to or after x. The tree is empty afterwards. O(log n).
+func (tr *{{.TreeT}}) {{.F.split}}({{.ValParams "x"}}) (lt, ge {{.TreeT}}) {
+	return tr.splitVal{{.Sfx}}({{.ValArgs "x"}}, false)
+}
+{{- end -}}
+{{- if and .F.join .F.concat .F.deleteRangeVal}}
+
+// Delete all elements between lo and hi and return how many were
+// deleted. incLo and incHi decide if elements equal to lo and hi
+// are deleted too. O(k + log n) for k deleted elements.
+func (tr *{{.TreeT}}) {{.F.deleteRangeVal}}({{.ValParams "lo" "hi"}}, incLo, incHi bool) int {
+	l, rest := tr.splitVal{{.Sfx}}({{.ValArgs "lo"}}, !incLo)
+	mid, r := rest.splitVal{{.Sfx}}({{.ValArgs "hi"}}, incHi)
+	tr.{{.F.concat}}(l, r)
+	// Elements that are dropped from a tree with parent
+	// pointers must not look like they are still in it.
+	return mid.drop({{.Parent}})
+}
+{{- end -}}
+{{- if or .F.rankVal .F.countRange}}
+
+// Helper function, don't use.
+// Count the elements before x, and equal to x if inc.
+func (tr *{{.TreeT}}) countValLess{{.Sfx}}({{.ValParams "x"}}, inc bool) int {
+	r := 0
+	n := tr.n
+	for n != nil {
+		eq, less := n.{{.CmpVal}}({{.ValArgs "x"}})
+		if less || (eq && inc) {
+			r += n.{{.LinkN}}.nodes[1].size() + 1
+			n = n.{{.LinkN}}.nodes[0].n
+		} else {
+			n = n.{{.LinkN}}.nodes[1].n
+		}
+	}
+	return r
+}
+{{- end -}}
+{{- if .F.rankVal}}
+
+// Return the number of elements before x.
+func (tr *{{.TreeT}}) {{.F.rankVal}}({{.ValParams "x"}}) int {
+	return tr.countValLess{{.Sfx}}({{.ValArgs "x"}}, false)
+}
+{{- end -}}
+{{- if .F.countRange}}
+
+// Count the elements between start and end. incs, ince - include
+// elements equal to start/end in the count.
+func (tr *{{.TreeT}}) {{.F.countRange}}({{.ValParams "start" "end"}}, incs, ince bool) int {
+	c := tr.countValLess{{.Sfx}}({{.ValArgs "end"}}, ince) - tr.countValLess{{.Sfx}}({{.ValArgs "start"}}, !incs)
+	if c < 0 {
+		return 0
+	}
+	return c
+}
+{{- end -}}
+{{- if and .Augment .F.aggregateRange}}
+
+// Call node for every element and sub for the root of every subtree
+// that together make up exactly the elements from start to end, both
+// included. Combining the augmented data of those gives us
+// the aggregate of the range in O(log n). The calls are made in no
+// particular order.
+func (tr *{{.TreeT}}) {{.F.aggregateRange}}({{.ValParams "start" "end"}}, node, sub func(*{{.NodeT}})) {
+	// Find the element where the paths to start and end split.
+	n := tr.n
+	for n != nil {
+		if _, less := n.{{.CmpVal}}({{.ValArgs "start"}}); less {
+			n = n.{{.LinkN}}.nodes[0].n
+		} else if eq, less := n.{{.CmpVal}}({{.ValArgs "end"}}); !eq && !less {
+			n = n.{{.LinkN}}.nodes[1].n
+		} else {
+			break
+		}
+	}
+	if n == nil {
+		return
+	}
+	node(n)
+	// Everything on the way to start that isn't before start.
+	for m := n.{{.LinkN}}.nodes[1].n; m != nil; {
+		if _, less := m.{{.CmpVal}}({{.ValArgs "start"}}); less {
+			m = m.{{.LinkN}}.nodes[0].n
+		} else {
+			node(m)
+			if s := m.{{.LinkN}}.nodes[0].n; s != nil {
+				sub(s)
+			}
+			m = m.{{.LinkN}}.nodes[1].n
+		}
+	}
+	// Everything on the way to end that isn't after end.
+	for m := n.{{.LinkN}}.nodes[0].n; m != nil; {
+		if eq, less := m.{{.CmpVal}}({{.ValArgs "end"}}); !eq && !less {
+			m = m.{{.LinkN}}.nodes[1].n
+		} else {
+			node(m)
+			if s := m.{{.LinkN}}.nodes[1].n; s != nil {
+				sub(s)
+			}
+			m = m.{{.LinkN}}.nodes[0].n
+		}
+	}
+}
+{{- end -}}
+{{- if .F.rangeVal}}
+
+// Helper function, don't use.
+// Walk the elements between start and end in order until yield
+// returns false. cs, ce - start/end haven't been checked yet for
+// this subtree.
+func (tr *{{.TreeT}}) walkVal{{.Sfx}}(yield func(*{{.NodeT}}) bool, {{.ValParams "start" "end"}}, cs, ce bool) bool {
+	if tr.n == nil {
+		return true
+	}
+	if cs {
+		if _, less := tr.n.{{.CmpVal}}({{.ValArgs "start"}}); less {
+			return tr.n.{{.LinkN}}.nodes[0].walkVal{{.Sfx}}(yield, {{.ValArgs "start"}}, {{.ValArgs "end"}}, cs, ce)
+		}
+	}
+	if ce {
+		if eq, less := tr.n.{{.CmpVal}}({{.ValArgs "end"}}); !eq && !less {
+			return tr.n.{{.LinkN}}.nodes[1].walkVal{{.Sfx}}(yield, {{.ValArgs "start"}}, {{.ValArgs "end"}}, cs, ce)
+		}
+	}
+	return tr.n.{{.LinkN}}.nodes[1].walkVal{{.Sfx}}(yield, {{.ValArgs "start"}}, {{.ValArgs "end"}}, cs, false) &&
+		yield(tr.n) &&
+		tr.n.{{.LinkN}}.nodes[0].walkVal{{.Sfx}}(yield, {{.ValArgs "start"}}, {{.ValArgs "end"}}, false, ce)
+}
+
+// Iterator over the elements from start to end, both included.
+func (tr *{{.TreeT}}) {{.F.rangeVal}}({{.ValParams "start" "end"}}) iter.Seq[*{{.NodeT}}] {
+	return func(yield func(*{{.NodeT}}) bool) {
+		tr.walkVal{{.Sfx}}(yield, {{.ValArgs "start"}}, {{.ValArgs "end"}}, true, true)
+	}
+}
+{{- end -}}
+{{- if and .IterT .F.iterVal}}
+
+// start, end - start and end values of iteration.
+// edgeStart,edgeEnd - ignore start/end and start/end the iteration at the edge of the tree.
+// incs, ince - include the start/end value in the iteration.
+func (tr *{{.TreeT}}) {{.F.iterVal}}({{.ValParams "start" "end"}}, edgeStart, edgeEnd, incs, ince bool) *{{.IterT}} {
+	var s, e *{{.NodeT}}
+	if !edgeStart {
+		s = tr.nearVal{{.Sfx}}({{.ValArgs "start"}}, 1, false)
+		if s == nil {
+			// Everything is after start.
+			incs = true
+		} else if eq, _ := s.{{.CmpVal}}({{.ValArgs "start"}}); !eq {
+			// If we got a value before start,
+			// force incs to false since we don't
+			// want to include it.
+			incs = false
+		}
+	}
+	if !edgeEnd {
+		e = tr.nearVal{{.Sfx}}({{.ValArgs "end"}}, 0, false)
+		if e == nil {
+			// Everything is before end.
+			ince = true
+		} else if eq, _ := e.{{.CmpVal}}({{.ValArgs "end"}}); !eq {
+			// If we got a value after end,
+			// force ince to false since we don't
+			// want to include it.
+			ince = false
+		}
+	}
+	return tr.{{.F.iter}}(s, e, incs, ince)
+}
+{{- end -}}
+{{- if .IterT}}
+
+// Move the iterator to the first element equal to x or after it in
+// the direction of the iteration.
+func (it *{{.IterT}}) seekVal{{.Sfx}}({{.ValParams "x"}}) {
+	if it.rev {
+		it.seek(it.tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 1, false))
+	} else {
+		it.seek(it.tr.nearVal{{.Sfx}}({{.ValArgs "x"}}, 0, false))
+	}
+}
+{{- end -}}{{end}}`))
@@ -62,6 +62,111 @@
 // value. You're free to define "less" in whatever way you wish as
 // long as it is transitive (if a > b and b > c then a > c).
 //
+// If the comparison is already available as a three-way compare
+// (like "cmp.Compare" or "bytes.Compare") use "cmp3:<fn>" instead:
+//
+//	func (a *str)compare(b *str) int {
+//		return strings.Compare(a.key, b.key)
+//	}
+//
+// The function returns a negative number, zero or a positive number
+// when a is less than, equal to or greater than b. Avlgen generates
+// a small method on the node type that calls it once and returns
+// the two booleans. The same goes for "cmpval3:<fn>(<type>)" in
+// place of "cmpval" (see below).
+//
+// Most of the time the compare functions just compare a field or
+// two. Avlgen can write them for us:
+//
+//	type ev struct {
+//		tenant string
+//		ts     int64
+//		tl     tlink `avlgen:"evTree,key:tenant,ts desc"`
+//	}
+//
+// The tree is ordered by the fields after "key:", in the order they
+// are listed. The list ends at the first element of the tag that
+// isn't a field name or is a tag option, so a field named like an
+// option ("rank", "len", ...) can only be the first key field.
+// "desc" after a field name reverses the order for that field. The
+// fields can be of any type that works with "<" (types from other
+// packages get their packages imported) as well as "[]byte" and
+// "time.Time". Both the compare function and a
+// "cmpval" (as if it was "cmpval:<fn>(string,int64)" in the example)
+// are generated, so there's no need to write "cmp" or "cmpk".
+//
+// Adding "desc" to the tag reverses the order of the whole tree
+// without touching the compare functions, for example to have the
+// newest element first. "first", "last", iterators and everything
+// else that walks the tree follows the order of the tree, so "first"
+// returns the greatest element. Functions that take ranges take
+// them in the order of the tree too, the start is the greater
+// value. Functions that are named after an order (like
+// "searchValGEQ") keep the meaning of their names, "searchValGEQ"
+// still returns the nearest element that is greater than or equal
+// to its argument according to the compare function.
+//
+// When the elements are already sorted, for example when they are
+// loaded from a file that was written from a tree, there's:
+//
+//	(*<tree type>).buildSorted(nodes []*<node type>)
+//
+// It replaces the contents of the tree with the elements in "nodes"
+// and builds a perfectly balanced tree in O(n) without calling the
+// compare function. The elements must be sorted, this is not
+// checked.
+//
+// Whole trees can be glued together and cut apart in O(log n):
+//
+//	(*<tree type>).join(l <tree type>, mid *<node type>, r <tree type>)
+//	(*<tree type>).concat(l, r <tree type>)
+//	(*<tree type>).split(x <cmpval type>) (lt, ge <tree type>)
+//
+// "join" makes the tree contain all elements of l, then mid, then
+// all elements of r. "concat" does the same without the middle
+// element. The elements of l must be before the elements of r, this
+// is not checked. "split" (only with "cmpval") moves the elements
+// before x to lt and the rest to ge and leaves the tree empty.
+//
+// With "cmpval" a whole range of elements can be deleted at once:
+//
+//	(*<tree type>).deleteRangeVal(lo, hi <cmpval type>, incLo, incHi bool) int
+//
+// It deletes the elements between lo and hi ("incLo" and "incHi"
+// work like "incs" and "ince" for "iterVal") and returns how many
+// were deleted. The range is cut out with two splits and a concat,
+// so it is O(k + log n) for k deleted elements instead of k
+// separate deletes.
+//
+// On top of those we build set operations between two trees of the
+// same type:
+//
+//	(*<tree type>).union(o *<tree type>, conflict func(a, b *<node type>) *<node type>)
+//	(*<tree type>).intersection(o *<tree type>, conflict func(a, b *<node type>) *<node type>)
+//	(*<tree type>).difference(o *<tree type>)
+//
+// The result ends up in the tree. "union" and "intersection" empty
+// o, "difference" leaves o alone. When both trees have an equal
+// element "conflict" is called with the element from the tree and
+// the one from o and returns the one that should stay. A nil
+// "conflict" keeps the element from the tree. Elements are moved,
+// not copied, and nothing is allocated. Elements that end up in
+// neither tree are simply dropped.
+//
+// By default insert doesn't care about equal elements, they are
+// inserted as duplicates. This can be changed with
+// "dups:<policy>" in the tag:
+//
+//	dups:allow   - the default, insert duplicates.
+//	dups:ignore  - don't insert x if an equal element is in the tree.
+//	dups:reject  - same as ignore, but insert returns a bool that
+//	               is false if x wasn't inserted.
+//	dups:replace - x takes the place of the equal element and insert
+//	               returns the replaced element (or nil).
+//
+// All of them find the equal element in the same descent as the
+// insert, so there's no need to lookup before inserting.
+//
 // The next useful feature is obvious from the above "lookup"
 // example. It's quite wasteful to allocate a fake struct to perform
 // lookups just because our compare function only understands how to
@@ -83,22 +188,98 @@
 //
 // The type (string in this case) can be anything, of course. It's
 // specified in the tag and the code is generated correctly for any
-// key types (it shouldn't be too hard to add multiple arguments to
-// the cmpk/lookupVal functions in case of more complex keys, but this
-// isn't implemented yet).
+// key types. More complex keys can be passed as multiple arguments:
+//
+//	type ev struct {
+//		tenant string
+//		ts     int64
+//		tl     tlink `avlgen:"evTree,cmpval:cmpk(string,int64)"`
+//	}
+//	func (a *ev)cmpk(tenant string, ts int64) (bool, bool) {
+//		...
+//	}
+//
+// Then lookupVal, deleteVal and all the other functions that take
+// values take the same list of arguments. Functions that take a
+// start and an end take all the start arguments first:
+//
+//	s := tr.lookupVal("foo", 17)
+//	it := tr.iterVal("foo", 0, "foo", 100, false, false, true, true)
+//
+// A tree can have more than one "cmpval", for example to search a
+// tree of strings with a byte slice without converting it:
+//
+//	tl tlink `avlgen:"strTree,cmpval:cmpk(string),cmpval:cmpb([]byte)"`
+//
+// The first one gets the plain names described here, the functions
+// for the others get the name of their compare function as a suffix:
+// lookupValCmpb, deleteValCmpb, iterValCmpb and so on. All of them
+// must order the elements the same way as the compare function.
 //
 // There is obviously no "insertVal" function since it is expected
-// that structs are much more complex than this example.
+// that structs are much more complex than this example. What we have
+// instead is:
+//
+//	(*<tree type>).getOrInsertVal(x <cmpval type>, mk func() *<node type>) (n *<node type>, inserted bool)
+//
+// It returns the element equal to x if there is one. Otherwise it
+// calls "mk" to build the element and inserts it where the search
+// ended without walking the tree again. Useful for interning and
+// deduplication.
 //
 // When "cmpval" is specified we also implement two more functions:
 // searchValLEQ and searchValGEQ. They behave like lookup, but in case
 // there's no equal element, they return the nearest less than (LEQ)
 // or greater than (GEQ) node.
 //
+// The full set of searches for nearby elements is:
+//
+//	(*<tree type>).floor(x *<node type>) *<node type>
+//	(*<tree type>).ceiling(x *<node type>) *<node type>
+//	(*<tree type>).lower(x *<node type>) *<node type>
+//	(*<tree type>).higher(x *<node type>) *<node type>
+//
+// "floor" returns the greatest element less than or equal to x,
+// "ceiling" the least element greater than or equal to x, "lower"
+// and "higher" the same but strictly less/greater than x. They
+// return nil if there is no such element. With "cmpval" we also get
+// "floorVal", "ceilingVal", "lowerVal" and "higherVal" that take a
+// value instead ("searchValLEQ" and "searchValGEQ" are the same as
+// "floorVal" and "ceilingVal"). All of them make a single descent
+// and call one compare function per level.
+//
 // The big selling point of trees is that they are ordered, but this
 // is useless unless we can actually see the elements in order. The
 // previously mentioned "first" and "last" functions will only get us
-// so far. We add iterators by adding "iter" to the tag:
+// so far. The neighbours of an element are available through:
+//
+//	(*<tree type>).next(x *<node type>) *<node type>
+//	(*<tree type>).prev(x *<node type>) *<node type>
+//
+// They return nil at the edges of the tree. They search for x from
+// the root, so they are O(log n) each, unless the tree has parent
+// pointers (see below) which makes them O(1) amortized.
+//
+// Trees are also useful as priority queues:
+//
+//	(*<tree type>).popFirst() *<node type>
+//	(*<tree type>).popLast() *<node type>
+//
+// remove and return the first/last element (nil if the tree is
+// empty). Unlike "first" followed by "delete" they only descend
+// once and never call the compare function.
+//
+// To empty a tree there's:
+//
+//	(*<tree type>).clear(unlink bool)
+//
+// Just setting the root to nil leaves the elements pointing at each
+// other, so any element that survives keeps its old subtree
+// reachable. With "unlink" clear walks the tree and zeroes the link
+// of every element, which is O(n) instead of O(1). Trees with parent
+// pointers always unlink.
+//
+// We add iterators by adding "iter" to the tag:
 //
 //	type str struct {
 //		key string
@@ -129,6 +310,27 @@
 // bigger than the end element and will perform the iteration
 // backwards.
 //
+// Iterators can be repositioned without allocating a new one:
+//
+//	it.seek(n)       - next returns n, the rest of the iteration as before.
+//	it.seekVal(x)    - seek to the first element equal to or after x
+//	                   in the direction of the iteration (needs "cmpval").
+//	it.reset(rev)    - start over and iterate over the whole tree,
+//	                   backwards if rev is set.
+//	it.reverse()     - turn around and iterate from the current element
+//	                   to the other edge of the tree.
+//
+// Seeking past the end of the iteration ends the iteration.
+//
+// The tree must not be modified while iterating, with one exception.
+// The element last returned by "value" can be deleted with:
+//
+//	it.deleteCurrent()
+//
+// and the iteration continues with the next element as if nothing
+// happened. Before the first call to "next" (and after "seek" or
+// "reset") there is no such element and it does nothing.
+//
 // If the tree has the "cmpval" function specified, we also get a
 // convenience function:
 //
@@ -140,6 +342,100 @@
 // ignore the start/end arguments and start/end at the edge of the
 // tree.
 //
+// The iterators above predate range-over-func. With "seq" in the tag
+// we also get:
+//
+//	(*<tree type>).all() iter.Seq[*<node type>]
+//	(*<tree type>).backward() iter.Seq[*<node type>]
+//	(*<tree type>).rangeVal(start, end <cmpval type>) iter.Seq[*<node type>]
+//
+// which work with "for n := range tr.all()", "iter.Pull" and friends.
+// "rangeVal" (only with "cmpval") returns the elements where
+// "start <= el <= end". The tree must not be modified while
+// iterating.
+//
+// Adding "rank" to the tag turns the tree into an order statistic
+// tree. The link keeps the number of elements in each subtree next to
+// the height, this costs one int per element and a little bit of work
+// in every rebalance. In return we get:
+//
+//	(*<tree type>).nth(i int) *<node type>
+//	(*<tree type>).rank(x *<node type>) int
+//
+// "nth" returns the i:th element of the tree (counting from 0) and
+// "rank" returns the position of an element in the tree. Both are
+// O(log n). If "cmpval" is specified we also get:
+//
+//	(*<tree type>).rankVal(x <cmpval type>) int
+//	(*<tree type>).countRange(start, end <cmpval type>, incs, ince bool) int
+//
+// "rankVal" returns the number of elements before x. "countRange"
+// counts the elements between start and end with "incs" and "ince"
+// working the same way as for "iterVal".
+//
+// The link can also keep a pointer to the parent node by adding
+// "parent" to the tag. This costs a pointer per element and a few
+// more stores in every rotation, but "delete" no longer has to search
+// for the element (it finds its way to the root through the parents
+// and doesn't call the compare function at all) and iterators don't
+// need to keep the path to the current element. This means that
+// iterators stay valid when elements are inserted or deleted from
+// the tree while iterating. If the current element or the end of the
+// iteration is deleted, the iterator continues from the elements
+// nearest to where they were (with duplicates, elements equal to the
+// deleted one can be skipped). Deleted elements have their link
+// zeroed so that deleting them again is harmless. So do the old
+// elements of a tree whose contents are replaced by "buildSorted",
+// "join" or "concat", which costs O(n) for them.
+//
+// If all we want is the number of elements in the tree, "len" in the
+// tag gives us:
+//
+//	(*<tree type>).len() int
+//
+// It is O(1). It uses the same subtree counts as "rank" (which is
+// why it costs the same) so the count is kept correct by every
+// function that modifies the tree, even when we try to delete
+// elements that aren't in the tree. The tree type itself can't
+// carry the count because subtrees are trees too.
+//
+// The subtree counts are just one kind of data that can be kept
+// about subtrees. "augment:<method>" in the tag makes the tree call:
+//
+//	(*<node type>).<method>(smaller, bigger *<node type>)
+//
+// every time the subtree under an element has changed, with the
+// roots of its children (nil if missing). The method recomputes
+// whatever the element keeps about its subtree (a sum, a maximum,
+// etc.) from its own data and that of its children. The calls are
+// made bottom up through all insertions, deletions and rotations, so
+// the children are always up to date. With "cmpval" we also get:
+//
+//	(*<tree type>).aggregateRange(start, end <cmpval type>, node, sub func(*<node type>))
+//
+// which calls "node" for single elements and "sub" for roots of
+// whole subtrees that together cover exactly the elements where
+// "start <= el <= end". That's O(log n) calls, in no particular
+// order. Elements must not be modified in a way that changes the
+// augmented data while they are in the tree.
+//
+// A common augmentation is built in. "interval:<start>,<end>" in the
+// tag (both are names of fields in the node type, they must have the
+// same type and be comparable with "<") makes the tree an interval
+// tree. Each element is the half-open interval [start, end) and the
+// link keeps the biggest end in each subtree. The compare function
+// must order the elements by start (ties can be broken any way), so
+// "interval" can't be combined with "desc". We get:
+//
+//	(*<tree type>).overlaps(lo, hi <field type>) iter.Seq[*<node type>]
+//	(*<tree type>).stabbing(p <field type>) iter.Seq[*<node type>]
+//	(*<tree type>).anyOverlap(lo, hi <field type>) *<node type>
+//
+// "overlaps" returns the elements that overlap [lo, hi) and
+// "stabbing" the elements that contain p, both ordered by start.
+// They are O(k + log n) for k results. "anyOverlap" returns one
+// overlapping element in O(log n).
+//
 // By default all functions to access the tree are unexported, this
 // can be changed by adding "export" to the tag.
 //
@@ -159,6 +455,7 @@ import (
 	"go/build"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"log"
 	"os"
 	"reflect"
@@ -173,6 +470,24 @@ func parseFile(fs *token.FileSet, fname string, trees *avlgen.Trees) {
 	if err != nil {
 		log.Fatalf("parser.ParseFile(%s): %v", fname, err)
 	}
+	// Field types can refer to the packages this file imports.
+	trees.FieldPkgs = make(map[string]string)
+	for _, imp := range f.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			log.Fatalf("unquote: %v", err)
+		}
+		// Good enough guess of the package name for paths
+		// like "gopkg.in/yaml.v3".
+		name := path[strings.LastIndex(path, "/")+1:]
+		if i := strings.Index(name, "."); i > 0 {
+			name = name[:i]
+		}
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		trees.FieldPkgs[name] = path
+	}
 	ast.Inspect(f, func(n ast.Node) bool {
 		typ, ok := n.(*ast.TypeSpec)
 		if !ok {
@@ -182,6 +497,12 @@ func parseFile(fs *token.FileSet, fname string, trees *avlgen.Trees) {
 		if !ok {
 			return true
 		}
+		fields := make(map[string]string)
+		for _, f := range st.Fields.List {
+			for _, n := range f.Names {
+				fields[n.Name] = types.ExprString(f.Type)
+			}
+		}
 		for _, f := range st.Fields.List {
 			if f.Tag == nil {
 				continue
@@ -202,7 +523,7 @@ func parseFile(fs *token.FileSet, fname string, trees *avlgen.Trees) {
 			if len(f.Names) != 1 {
 				log.Fatalf("%s embed field name problem: %v", typ.Name.Name, f.Names)
 			}
-			err = trees.AddTree(typ.Name.Name, fType.Name, f.Names[0].Name, "", tv)
+			err = trees.AddTreeFields(typ.Name.Name, fType.Name, f.Names[0].Name, "", tv, fields)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -0,0 +1,86 @@
+package trees
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type aKV struct {
+	k, v     int
+	sum, max int
+	al       agl `avlgen:"akt,cmpval:cmpk(int),augment:sumMax,dups:replace,parent,debug"`
+}
+
+func (a *aKV) cmp(b *aKV) (bool, bool) {
+	return a.k == b.k, a.k < b.k
+}
+
+func (a *aKV) cmpk(b int) (bool, bool) {
+	return a.k == b, a.k < b
+}
+
+func (a *aKV) sumMax(l, r *aKV) {
+	a.sum, a.max = a.v, a.v
+	for _, c := range []*aKV{l, r} {
+		if c != nil {
+			a.sum += c.sum
+			if c.max > a.max {
+				a.max = c.max
+			}
+		}
+	}
+}
+
+func TestAugmentRandom(t *testing.T) {
+	const sz = 2000
+	tr := akt{}
+	vals := make(map[int]int)
+	for i := 0; i < sz*2; i++ {
+		k := rand.Intn(sz)
+		switch rand.Intn(3) {
+		case 0:
+			tr.deleteVal(k)
+			delete(vals, k)
+		default:
+			v := rand.Intn(1000)
+			tr.insert(&aKV{k: k, v: v})
+			vals[k] = v
+		}
+	}
+	checkTree(t, tr.foreach, tr.check)
+	tr.foreach(nil, nil, func(n *aKV) {
+		s, m := n.sum, n.max
+		n.sumMax(n.al.nodes[1].n, n.al.nodes[0].n)
+		if s != n.sum || m != n.max {
+			t.Errorf("%d: stale aggregate %d/%d != %d/%d", n.k, s, m, n.sum, n.max)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		start := rand.Intn(sz)
+		end := start + rand.Intn(sz/4)
+		es, em := 0, -1
+		for k, v := range vals {
+			if k >= start && k <= end {
+				es += v
+				if v > em {
+					em = v
+				}
+			}
+		}
+		s, m := 0, -1
+		tr.aggregateRange(start, end, func(n *aKV) {
+			s += n.v
+			if n.v > m {
+				m = n.v
+			}
+		}, func(n *aKV) {
+			s += n.sum
+			if n.max > m {
+				m = n.max
+			}
+		})
+		if s != es || m != em {
+			t.Errorf("[%d, %d]: %d/%d != %d/%d", start, end, s, m, es, em)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package trees
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Toggle random keys in and out of a tree and check the whole tree
+// after every operation. Most insertions and deletions don't change
+// the height all the way up, so rebalancing stops early in both.
+func churn(t *testing.T, insert, deleteVal func(int), check func(n int)) {
+	t.Helper()
+	r := rand.New(rand.NewSource(1))
+	in := make(map[int]bool)
+	for i := 0; i < 3000; i++ {
+		k := r.Intn(300)
+		if in[k] {
+			deleteVal(k)
+			delete(in, k)
+		} else {
+			insert(k)
+			in[k] = true
+		}
+		check(len(in))
+		if t.Failed() {
+			t.Fatalf("operation %d on %d broke the tree", i, k)
+		}
+	}
+}
+
+func TestBalanceChurn(t *testing.T) {
+	itr := ikvt{}
+	churn(t, func(k int) { itr.insert(&iKV{k: k}) }, itr.deleteVal, func(int) {
+		checkTree(t, itr.foreach, itr.check)
+	})
+	rtr := rkt{}
+	churn(t, func(k int) { rtr.insert(&rKV{k: k}) }, rtr.deleteVal, func(n int) {
+		checkTree(t, rtr.foreach, rtr.check)
+		if rtr.len() != n {
+			t.Errorf("len %d != %d", rtr.len(), n)
+		}
+	})
+	ptr := pkt{}
+	churn(t, func(k int) { ptr.insert(&pKV{k: k}) }, func(k int) {
+		// Half of the deletions go through the parent pointers.
+		if k%2 == 0 {
+			ptr.delete(ptr.lookupVal(k))
+		} else {
+			ptr.deleteVal(k)
+		}
+	}, func(n int) {
+		checkTree(t, ptr.foreach, ptr.check)
+		if ptr.len() != n {
+			t.Errorf("len %d != %d", ptr.len(), n)
+		}
+	})
+}
+
+func TestBalanceStopEarly(t *testing.T) {
+	a := make([]*rKV, 7)
+	for i := range a {
+		a[i] = &rKV{k: i + 1}
+	}
+	// 4 is the root with 2 and 6 under it, the rest are leaves.
+	tr := rkt{}
+	tr.buildSorted(a)
+	h := tr.height()
+	// 6 keeps its height when 7 comes and goes, so rebalancing
+	// stops there but the sizes above it must still change.
+	tr.delete(a[6])
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != 6 || tr.height() != h {
+		t.Errorf("delete: len %d height %d", tr.len(), tr.height())
+	}
+	tr.insert(a[6])
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != 7 || tr.height() != h {
+		t.Errorf("insert: len %d height %d", tr.len(), tr.height())
+	}
+	if n := tr.nth(6); n != a[6] {
+		t.Errorf("nth(6) = %v", n)
+	}
+}
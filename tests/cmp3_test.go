@@ -0,0 +1,55 @@
+package trees
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+type c3KV struct {
+	k  int
+	s  []byte
+	cl c3l `avlgen:"c3t,cmp3:compare,cmpval3:compareK(int),cmpval3:compareB([]byte),iter,debug"`
+}
+
+func (a *c3KV) compare(b *c3KV) int {
+	return cmp.Compare(a.k, b.k)
+}
+
+func (a *c3KV) compareK(k int) int {
+	return cmp.Compare(a.k, k)
+}
+
+func (a *c3KV) compareB(s []byte) int {
+	return bytes.Compare(a.s, s)
+}
+
+func TestCmp3(t *testing.T) {
+	tr := c3t{}
+	for _, i := range rand.Perm(1000) {
+		tr.insert(&c3KV{k: i * 2, s: []byte(fmt.Sprintf("%04d", i*2))})
+	}
+	checkTree(t, tr.foreach, tr.check)
+	for i := 0; i < 2000; i++ {
+		n := tr.lookupVal(i)
+		if (n != nil) != (i%2 == 0) || (n != nil && n.k != i) {
+			t.Errorf("lookupVal(%d): %v", i, n)
+		}
+		if nb := tr.lookupValCompareB([]byte(fmt.Sprintf("%04d", i))); nb != n {
+			t.Errorf("lookupValCompareB(%d): %v", i, nb)
+		}
+		if g := tr.searchValGEQ(i); i < 1999 && (g == nil || g.k != (i+1)/2*2) {
+			t.Errorf("searchValGEQ(%d): %v", i, g)
+		}
+	}
+	it := tr.iterVal(10, 20, false, false, true, false)
+	c := 0
+	for it.next() {
+		c++
+	}
+	if c != 5 {
+		t.Errorf("iterVal: %d", c)
+	}
+}
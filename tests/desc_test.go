@@ -0,0 +1,97 @@
+package trees
+
+import (
+	"cmp"
+	"math/rand"
+	"testing"
+)
+
+type dsKV struct {
+	ts  int64
+	dsl dsl `avlgen:"dst,cmpval:cmpk(int64),desc,iter,seq,rank,debug"`
+	dkl dkl `avlgen:"dkt,key:ts,desc"`
+	d3l d3l `avlgen:"d3t,cmp3:compare,desc"`
+}
+
+func (a *dsKV) cmp(b *dsKV) (bool, bool) {
+	return a.ts == b.ts, a.ts < b.ts
+}
+
+func (a *dsKV) cmpk(ts int64) (bool, bool) {
+	return a.ts == ts, a.ts < ts
+}
+
+func (a *dsKV) compare(b *dsKV) int {
+	return cmp.Compare(a.ts, b.ts)
+}
+
+func TestDesc(t *testing.T) {
+	tr, ktr, ctr := dst{}, dkt{}, d3t{}
+	for _, i := range rand.Perm(100) {
+		n := &dsKV{ts: int64(i * 2)}
+		tr.insert(n)
+		ktr.insert(n)
+		ctr.insert(n)
+	}
+	checkTree(t, tr.foreach, tr.check)
+	if tr.first().ts != 198 || tr.last().ts != 0 {
+		t.Errorf("first/last %d %d", tr.first().ts, tr.last().ts)
+	}
+	if ktr.first().ts != 198 || ctr.first().ts != 198 {
+		t.Errorf("key/cmp3 first %d %d", ktr.first().ts, ctr.first().ts)
+	}
+	if n := ktr.lookupVal(42); n == nil || n.ts != 42 {
+		t.Errorf("key lookupVal %v", n)
+	}
+	// The names still mean what they say.
+	if n := tr.searchValGEQ(41); n == nil || n.ts != 42 {
+		t.Errorf("searchValGEQ %v", n)
+	}
+	if n := tr.searchValLEQ(41); n == nil || n.ts != 40 {
+		t.Errorf("searchValLEQ %v", n)
+	}
+	// Ranges are in tree order.
+	it := tr.iterVal(51, 41, false, false, true, true)
+	ts := int64(50)
+	for it.next() {
+		if it.value().ts != ts {
+			t.Errorf("iterVal %d != %d", it.value().ts, ts)
+		}
+		ts -= 2
+	}
+	if ts != 40 {
+		t.Errorf("iterVal stopped at %d", ts)
+	}
+	if c := tr.countRange(50, 42, true, true); c != 5 {
+		t.Errorf("countRange %d", c)
+	}
+	if r := tr.rankVal(190); r != 4 {
+		t.Errorf("rankVal %d", r)
+	}
+	ts = 198
+	for n := range tr.all() {
+		if n.ts != ts {
+			t.Errorf("all %d != %d", n.ts, ts)
+		}
+		ts -= 2
+	}
+}
+
+func TestDescNavigable(t *testing.T) {
+	tr := dst{}
+	for i := 0; i < 100; i++ {
+		tr.insert(&dsKV{ts: int64(i * 2)})
+	}
+	if n := tr.floorVal(41); n == nil || n.ts != 40 {
+		t.Errorf("floorVal %v", n)
+	}
+	if n := tr.ceilingVal(41); n == nil || n.ts != 42 {
+		t.Errorf("ceilingVal %v", n)
+	}
+	if n := tr.lower(&dsKV{ts: 40}); n == nil || n.ts != 38 {
+		t.Errorf("lower %v", n)
+	}
+	if n := tr.higher(&dsKV{ts: 40}); n == nil || n.ts != 42 {
+		t.Errorf("higher %v", n)
+	}
+}
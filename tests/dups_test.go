@@ -0,0 +1,90 @@
+package trees
+
+import "testing"
+
+type dKV struct {
+	k, v int
+	dil  dil `avlgen:"dit,dups:ignore,len"`
+	drl  drl `avlgen:"drt,dups:reject,len"`
+	dpl  dpl `avlgen:"dpt,dups:replace,len,debug"`
+	dql  dql `avlgen:"dqt,dups:replace,parent,len,debug"`
+}
+
+func (a *dKV) cmp(b *dKV) (bool, bool) {
+	return a.k == b.k, a.k < b.k
+}
+
+func TestDupsIgnore(t *testing.T) {
+	tr := dit{}
+	for i := 0; i < 100; i++ {
+		tr.insert(&dKV{k: i % 10, v: i})
+	}
+	if tr.len() != 10 {
+		t.Errorf("len %d != 10", tr.len())
+	}
+	for i := 0; i < 10; i++ {
+		if n := tr.lookup(&dKV{k: i}); n.v != i {
+			t.Errorf("%d: %d != %d", i, n.v, i)
+		}
+	}
+}
+
+func TestDupsReject(t *testing.T) {
+	tr := drt{}
+	for i := 0; i < 100; i++ {
+		if ok := tr.insert(&dKV{k: i % 10, v: i}); ok != (i < 10) {
+			t.Errorf("insert %d: %v", i, ok)
+		}
+	}
+	if tr.len() != 10 {
+		t.Errorf("len %d != 10", tr.len())
+	}
+}
+
+func TestDupsReplace(t *testing.T) {
+	tr := dpt{}
+	for i := 0; i < 100; i++ {
+		x := &dKV{k: i % 10, v: i}
+		old := tr.insert(x)
+		if i < 10 {
+			if old != nil {
+				t.Errorf("insert %d: %v", i, old)
+			}
+		} else if old == nil || old.k != x.k || old.v != i-10 {
+			t.Errorf("insert %d: %v", i, old)
+		}
+	}
+	if tr.len() != 10 {
+		t.Errorf("len %d != 10", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+	tr.foreach(nil, nil, func(n *dKV) {
+		if n.v < 90 {
+			t.Errorf("%v not replaced", n)
+		}
+	})
+}
+
+func TestDupsReplaceParent(t *testing.T) {
+	tr := dqt{}
+	var old []*dKV
+	for i := 0; i < 30; i++ {
+		if o := tr.insert(&dKV{k: i % 15, v: i}); o != nil {
+			old = append(old, o)
+		}
+	}
+	// The replaced elements aren't in the tree, deleting them
+	// must not touch the tree.
+	for _, o := range old {
+		tr.delete(o)
+	}
+	if tr.len() != 15 {
+		t.Errorf("len %d != 15", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+	tr.foreach(nil, nil, func(n *dKV) {
+		if n.v < 15 {
+			t.Errorf("%v not replaced", n)
+		}
+	})
+}
@@ -0,0 +1,13 @@
+package trees
+
+import "testing"
+
+// Check every element of a tree generated with "debug".
+func checkTree[N any](t *testing.T, foreach func(b, m, a func(N)), check func(N) error) {
+	t.Helper()
+	foreach(nil, nil, func(n N) {
+		if err := check(n); err != nil {
+			t.Error(err)
+		}
+	})
+}
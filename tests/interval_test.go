@@ -0,0 +1,135 @@
+package trees
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type ivKV struct {
+	start, end int
+	id         int
+	il         ivl `avlgen:"ivt,interval:start,end,dups:replace,debug"`
+}
+
+func (a *ivKV) cmp(b *ivKV) (bool, bool) {
+	if a.start != b.start {
+		return false, a.start < b.start
+	}
+	return a.id == b.id, a.id < b.id
+}
+
+func TestIntervalRandom(t *testing.T) {
+	const sz = 2000
+	tr := ivt{}
+	in := make(map[int]*ivKV)
+	for i := 0; i < sz*2; i++ {
+		id := rand.Intn(sz)
+		if n := in[id]; n != nil && i%3 == 0 {
+			tr.delete(n)
+			delete(in, id)
+			continue
+		}
+		s := rand.Intn(sz * 10)
+		n := &ivKV{start: s, end: s + rand.Intn(100), id: id}
+		if o := in[id]; o != nil {
+			tr.delete(o)
+		}
+		tr.insert(n)
+		in[id] = n
+	}
+	checkTree(t, tr.foreach, tr.check)
+
+	for i := 0; i < 200; i++ {
+		lo := rand.Intn(sz * 10)
+		hi := lo + rand.Intn(50)
+		expect := 0
+		for _, n := range in {
+			if n.start < hi && lo < n.end {
+				expect++
+			}
+		}
+		got, last := 0, -1
+		for n := range tr.overlaps(lo, hi) {
+			if !(n.start < hi && lo < n.end) {
+				t.Errorf("[%d, %d) doesn't overlap [%d, %d)", n.start, n.end, lo, hi)
+			}
+			if n.start < last {
+				t.Errorf("out of order %d < %d", n.start, last)
+			}
+			last = n.start
+			got++
+		}
+		if got != expect {
+			t.Errorf("overlaps(%d, %d): %d != %d", lo, hi, got, expect)
+		}
+		a := tr.anyOverlap(lo, hi)
+		if (a != nil) != (expect > 0) {
+			t.Errorf("anyOverlap(%d, %d): %v, expected %d", lo, hi, a, expect)
+		} else if a != nil && !(a.start < hi && lo < a.end) {
+			t.Errorf("anyOverlap(%d, %d): [%d, %d)", lo, hi, a.start, a.end)
+		}
+
+		expect = 0
+		for _, n := range in {
+			if n.start <= lo && lo < n.end {
+				expect++
+			}
+		}
+		got = 0
+		for n := range tr.stabbing(lo) {
+			if !(n.start <= lo && lo < n.end) {
+				t.Errorf("[%d, %d) doesn't contain %d", n.start, n.end, lo)
+			}
+			got++
+		}
+		if got != expect {
+			t.Errorf("stabbing(%d): %d != %d", lo, got, expect)
+		}
+	}
+}
+
+func TestIntervalEdges(t *testing.T) {
+	tr := ivt{}
+	tr.insert(&ivKV{start: 10, end: 20, id: 1})
+	tr.insert(&ivKV{start: 20, end: 30, id: 2})
+	tr.insert(&ivKV{start: 25, end: 25, id: 3})
+	tests := []struct {
+		lo, hi int
+		n      int
+	}{
+		{0, 10, 0},
+		{0, 11, 1},
+		{19, 20, 1},
+		{20, 20, 0},
+		{20, 21, 1},
+		{19, 21, 2},
+		{30, 40, 0},
+	}
+	for _, tc := range tests {
+		n := 0
+		for range tr.overlaps(tc.lo, tc.hi) {
+			n++
+		}
+		if n != tc.n {
+			t.Errorf("overlaps(%d, %d): %d != %d", tc.lo, tc.hi, n, tc.n)
+		}
+	}
+	for p, id := range map[int]int{9: 0, 10: 1, 19: 1, 20: 2, 25: 2, 30: 0} {
+		n := 0
+		for x := range tr.stabbing(p) {
+			if x.id != id {
+				t.Errorf("stabbing(%d): %d != %d", p, x.id, id)
+			}
+			n++
+		}
+		if (n == 1) != (id != 0) {
+			t.Errorf("stabbing(%d): %d elements", p, n)
+		}
+	}
+	// Replacing an element must update maxEnd above it.
+	tr.insert(&ivKV{start: 20, end: 100, id: 2})
+	checkTree(t, tr.foreach, tr.check)
+	if tr.anyOverlap(90, 91) == nil {
+		t.Errorf("replaced element not found")
+	}
+}
@@ -135,6 +135,57 @@ func TestIntsSearchLEQ(t *testing.T) {
 	}
 }
 
+func TestIntsGetOrInsert(t *testing.T) {
+	tr := ikvt{}
+
+	for i := 0; i < 1000; i++ {
+		k := i % 100
+		n, inserted := tr.getOrInsertVal(k, func() *iKV { return &iKV{k: k, v: i} })
+		if inserted != (i < 100) {
+			t.Errorf("%d: inserted %v", i, inserted)
+		}
+		if n.k != k || n.v != k {
+			t.Errorf("%d: bad node %v", i, n)
+		}
+	}
+	checkTree(t, tr.foreach, tr.check)
+	c := 0
+	tr.foreach(nil, nil, func(*iKV) { c++ })
+	if c != 100 {
+		t.Errorf("wrong number of elements: %d", c)
+	}
+}
+
+func TestIntsNextPrev(t *testing.T) {
+	tr := ikvt{}
+
+	for i := 0; i < 1000; i += 2 {
+		tr.insert(&iKV{k: i, v: i})
+	}
+	i := 0
+	for n := tr.first(); n != nil; n = tr.next(n) {
+		if n.k != i {
+			t.Errorf("next %d != %d", n.k, i)
+		}
+		i += 2
+	}
+	if i != 1000 {
+		t.Errorf("next stopped at %d", i)
+	}
+	for n := tr.last(); n != nil; n = tr.prev(n) {
+		i -= 2
+		if n.k != i {
+			t.Errorf("prev %d != %d", n.k, i)
+		}
+	}
+	if i != 0 {
+		t.Errorf("prev stopped at %d", i)
+	}
+	if n := tr.next(&iKV{k: 17}); n != nil {
+		t.Errorf("next of element not in tree: %v", n)
+	}
+}
+
 func TestIntsCoverage(t *testing.T) {
 	// This test triggers edge cases to get better coverage
 	tr := ikvt{}
@@ -267,6 +318,244 @@ func TestIntsIter(t *testing.T) {
 	})
 }
 
+func TestIntsIterDelete(t *testing.T) {
+	tr := ikvt{}
+
+	for i := 0; i < 1000; i++ {
+		tr.insert(&iKV{k: i, v: i})
+	}
+	it := tr.iterVal(100, 900, false, false, true, true)
+	i := 100
+	for it.next() {
+		n := it.value()
+		if n.k != i {
+			t.Errorf("%d != %d", n.k, i)
+		}
+		if n.k%3 == 0 {
+			it.deleteCurrent()
+		}
+		i++
+	}
+	if i != 901 {
+		t.Errorf("iteration stopped at %d", i)
+	}
+	checkTree(t, tr.foreach, tr.check)
+	c := 0
+	tr.foreach(nil, nil, func(n *iKV) {
+		if n.k >= 100 && n.k <= 900 && n.k%3 == 0 {
+			t.Errorf("%d not deleted", n.k)
+		}
+		c++
+	})
+	if c != 1000-267 {
+		t.Errorf("wrong number left: %d", c)
+	}
+}
+
+func TestIntsIterDeleteEdges(t *testing.T) {
+	tr := ikvt{}
+	for i := 0; i < 100; i++ {
+		tr.insert(&iKV{k: i, v: i})
+	}
+	// Nothing has been returned yet, so there's nothing to delete.
+	it := tr.iterVal(10, 20, false, false, false, true)
+	it.deleteCurrent()
+	if tr.lookupVal(10) == nil || tr.lookupVal(11) == nil {
+		t.Errorf("deleteCurrent before next deleted something")
+	}
+	if !it.next() || it.value().k != 11 {
+		t.Fatalf("first element not 11")
+	}
+
+	// Delete the last element, then turn around.
+	for it.next() {
+	}
+	it.seekVal(20)
+	if !it.next() || it.value().k != 20 {
+		t.Fatalf("seek to 20")
+	}
+	it.deleteCurrent()
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+	it.reverse()
+	for i := 19; i >= 0; i-- {
+		if !it.next() || it.value().k != i {
+			t.Fatalf("expected %d", i)
+		}
+	}
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+
+	// Delete the last element, then seek back.
+	it = tr.iterVal(30, 40, false, false, true, true)
+	for it.next() {
+		if it.value().k == 40 {
+			it.deleteCurrent()
+		}
+	}
+	it.seekVal(35)
+	for i := 35; i < 40; i++ {
+		if !it.next() || it.value().k != i {
+			t.Fatalf("expected %d", i)
+		}
+	}
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+
+	// Delete the only element.
+	one := ikvt{}
+	one.insert(&iKV{k: 1})
+	it = one.iter(nil, nil, true, true)
+	if !it.next() {
+		t.Fatal("empty")
+	}
+	it.deleteCurrent()
+	it.reverse()
+	it.seekVal(1)
+	if it.next() || one.n != nil {
+		t.Errorf("deleted the only element")
+	}
+	checkTree(t, tr.foreach, tr.check)
+}
+
+func TestIntsIterSeek(t *testing.T) {
+	tr := ikvt{}
+
+	for i := 0; i < 1000; i += 2 {
+		tr.insert(&iKV{k: i, v: i})
+	}
+	expect := func(it *ikvtIter, k int) {
+		t.Helper()
+		if !it.next() {
+			t.Fatalf("iteration ended, expected %d", k)
+		}
+		if v := it.value().k; v != k {
+			t.Errorf("%d != %d", v, k)
+		}
+	}
+	it := tr.iterVal(0, 500, true, false, true, true)
+	expect(it, 0)
+	it.seek(tr.lookupVal(100))
+	expect(it, 100)
+	expect(it, 102)
+	it.seekVal(201)
+	expect(it, 202)
+	it.seekVal(499)
+	expect(it, 500)
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+	it.seekVal(600)
+	if it.next() {
+		t.Errorf("seek past end: %v", it.value())
+	}
+	it.reverse()
+	expect(it, 498)
+	expect(it, 496)
+	it.seekVal(51)
+	expect(it, 50)
+	it.reverse()
+	expect(it, 52)
+	it.reset(true)
+	expect(it, 998)
+	expect(it, 996)
+	it.reverse()
+	expect(it, 998)
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+	it.reset(false)
+	for i := 0; i < 1000; i += 2 {
+		expect(it, i)
+	}
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+
+	// Seeking back after the end keeps the end inclusive.
+	it = tr.iterVal(14, 18, false, false, true, true)
+	for it.next() {
+	}
+	it.seekVal(14)
+	expect(it, 14)
+	expect(it, 16)
+	expect(it, 18)
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+}
+
+// iterVal with bounds outside of the tree iterates up to the edges.
+func TestIntsIterValBounds(t *testing.T) {
+	tr := ikvt{}
+	for _, i := range rand.Perm(100) {
+		tr.insert(&iKV{k: i * 2})
+	}
+	for _, tc := range []struct{ s, e, n int }{{-10, 10, 6}, {190, 300, 5}, {-10, 300, 100}, {-10, -5, 0}, {300, 400, 0}} {
+		n := 0
+		it := tr.iterVal(tc.s, tc.e, false, false, true, true)
+		for it.next() {
+			n++
+		}
+		if n != tc.n {
+			t.Errorf("iterVal(%d, %d): %d != %d", tc.s, tc.e, n, tc.n)
+		}
+	}
+}
+
+func TestIntsNavigable(t *testing.T) {
+	tr := ikvt{}
+	for _, i := range rand.Perm(100) {
+		tr.insert(&iKV{k: i * 2})
+	}
+	k := func(n *iKV) int {
+		if n == nil {
+			return -1
+		}
+		return n.k
+	}
+	for i := -1; i < 201; i++ {
+		floor, ceiling, lower, higher := i, i, i-1, i+1
+		if i%2 != 0 {
+			floor, ceiling = i-1, i+1
+		} else {
+			lower, higher = i-2, i+2
+		}
+		if floor < 0 {
+			floor = -1
+		} else if floor > 198 {
+			floor = 198
+		}
+		if lower < 0 {
+			lower = -1
+		} else if lower > 198 {
+			lower = 198
+		}
+		if ceiling > 198 {
+			ceiling = -1
+		}
+		if higher > 198 {
+			higher = -1
+		}
+		x := &iKV{k: i}
+		if n := k(tr.floor(x)); n != floor || k(tr.floorVal(i)) != n {
+			t.Errorf("floor(%d) = %d, expected %d", i, n, floor)
+		}
+		if n := k(tr.ceiling(x)); n != ceiling || k(tr.ceilingVal(i)) != n {
+			t.Errorf("ceiling(%d) = %d, expected %d", i, n, ceiling)
+		}
+		if n := k(tr.lower(x)); n != lower || k(tr.lowerVal(i)) != n {
+			t.Errorf("lower(%d) = %d, expected %d", i, n, lower)
+		}
+		if n := k(tr.higher(x)); n != higher || k(tr.higherVal(i)) != n {
+			t.Errorf("higher(%d) = %d, expected %d", i, n, higher)
+		}
+	}
+}
+
 func fastPop(sz int) *ikvt {
 	tr := ikvt{}
 	a := make([]iKV, sz)
@@ -293,6 +582,20 @@ func BenchmarkII1M(b *testing.B) {
 			b.SetBytes(benchsz)
 		}
 	})
+	b.Run("buildSorted", func(b *testing.B) {
+		for bn := 0; bn < b.N; bn++ {
+			b.ReportAllocs()
+			b.StopTimer()
+			a := make([]*iKV, benchsz)
+			for i := range a {
+				a[i] = &iKV{k: i, v: i * 3}
+			}
+			b.StartTimer()
+			tr = ikvt{}
+			tr.buildSorted(a)
+			b.SetBytes(benchsz)
+		}
+	})
 	offs = rand.Perm(benchsz) // reinit offs so that lookups aren't the same permutation as inserts.
 	// we have one tree left
 	b.Run("lookup", func(b *testing.B) {
@@ -0,0 +1,84 @@
+package trees
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type kKV struct {
+	tenant string
+	ts     int64
+	kl     kl `avlgen:"kkt,key:tenant,ts desc,iter,debug"`
+}
+
+type kbKV struct {
+	raw  []byte
+	when time.Time
+	kbl  kbl `avlgen:"kbt,key:raw desc,when,debug"`
+}
+
+// A field with the name of a tag option.
+type krKV struct {
+	k    int
+	rank int
+	krl  krl `avlgen:"krt,key:rank,k,rank,debug"`
+}
+
+func TestKeyFields(t *testing.T) {
+	tr := kkt{}
+	for _, i := range rand.Perm(1000) {
+		tr.insert(&kKV{tenant: fmt.Sprintf("t%d", i%10), ts: int64(i / 10)})
+	}
+	checkTree(t, tr.foreach, tr.check)
+	if n := tr.lookupVal("t3", 17); n == nil || n.tenant != "t3" || n.ts != 17 {
+		t.Errorf("lookupVal: %v", n)
+	}
+	// ts is descending within each tenant.
+	if n := tr.first(); n.tenant != "t0" || n.ts != 99 {
+		t.Errorf("first: %v", n)
+	}
+	if n := tr.searchValGEQ("t3", -1); n == nil || n.tenant != "t4" || n.ts != 99 {
+		t.Errorf("searchValGEQ: %v", n)
+	}
+	it := tr.iterVal("t5", 50, "t5", 41, false, false, true, true)
+	ts := int64(50)
+	for it.next() {
+		if n := it.value(); n.tenant != "t5" || n.ts != ts {
+			t.Errorf("iterVal: %v", n)
+		}
+		ts--
+	}
+	if ts != 40 {
+		t.Errorf("iterVal stopped at %d", ts)
+	}
+
+	btr := kbt{}
+	now := time.Now()
+	for _, i := range rand.Perm(100) {
+		btr.insert(&kbKV{raw: []byte{byte(i % 5)}, when: now.Add(time.Duration(i/5) * time.Second)})
+	}
+	checkTree(t, btr.foreach, btr.check)
+	if n := btr.first(); n.raw[0] != 4 || !n.when.Equal(now) {
+		t.Errorf("first: %v", n)
+	}
+	if n := btr.lookupVal([]byte{2}, now.Add(7*time.Second)); n == nil {
+		t.Errorf("lookupVal")
+	}
+}
+
+func TestKeyFieldOption(t *testing.T) {
+	tr := krt{}
+	for _, i := range rand.Perm(100) {
+		tr.insert(&krKV{k: i % 10, rank: i / 10})
+	}
+	checkTree(t, tr.foreach, tr.check)
+	// rank is both a key field and the option.
+	if r := tr.rankVal(3, 4); r != 34 {
+		t.Errorf("rankVal %d", r)
+	}
+	if n := tr.nth(57); n.rank != 5 || n.k != 7 {
+		t.Errorf("nth: %v", n)
+	}
+}
@@ -0,0 +1,32 @@
+package trees
+
+import "testing"
+
+type lenKV struct {
+	x   int
+	lnl lnl `avlgen:"lnt,cmp:cmpx,len,debug"`
+}
+
+func (a *lenKV) cmpx(b *lenKV) (bool, bool) {
+	return a.x == b.x, a.x < b.x
+}
+
+func TestLen(t *testing.T) {
+	tr := lnt{}
+	if tr.len() != 0 {
+		t.Errorf("len %d != 0", tr.len())
+	}
+	tr.insert(&lenKV{x: 1})
+	tr.insert(&lenKV{x: 3})
+	tr.insert(&lenKV{x: 2})
+	// Not in the tree.
+	tr.delete(&lenKV{x: 17})
+	if tr.len() != 3 {
+		t.Errorf("len %d != 3", tr.len())
+	}
+	tr.delete(tr.lookup(&lenKV{x: 3}))
+	if tr.len() != 2 {
+		t.Errorf("len %d != 2", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+}
@@ -0,0 +1,123 @@
+package trees
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+type mkKV struct {
+	tenant string
+	ts     int64
+	ml     mkl `avlgen:"mkt,cmpval:cmpk(string, int64),iter,seq,rank,len,debug"`
+}
+
+func (a *mkKV) cmp(b *mkKV) (bool, bool) {
+	return a.cmpk(b.tenant, b.ts)
+}
+
+func (a *mkKV) cmpk(tenant string, ts int64) (bool, bool) {
+	if a.tenant != tenant {
+		return false, a.tenant < tenant
+	}
+	return a.ts == ts, a.ts < ts
+}
+
+func TestMultiKey(t *testing.T) {
+	tr := mkt{}
+	for _, i := range rand.Perm(1000) {
+		tr.insert(&mkKV{tenant: fmt.Sprintf("t%d", i%10), ts: int64(i / 10)})
+	}
+	checkTree(t, tr.foreach, tr.check)
+	if n := tr.lookupVal("t3", 17); n == nil || n.tenant != "t3" || n.ts != 17 {
+		t.Errorf("lookupVal: %v", n)
+	}
+	if n := tr.lookupVal("t3", 100); n != nil {
+		t.Errorf("lookupVal: %v", n)
+	}
+	if n := tr.searchValGEQ("t3", 100); n == nil || n.tenant != "t4" || n.ts != 0 {
+		t.Errorf("searchValGEQ: %v", n)
+	}
+	if n := tr.searchValLEQ("t4", -1); n == nil || n.tenant != "t3" || n.ts != 99 {
+		t.Errorf("searchValLEQ: %v", n)
+	}
+	if c := tr.countRange("t3", 0, "t3", 1000, true, true); c != 100 {
+		t.Errorf("countRange: %d", c)
+	}
+	n := 0
+	for x := range tr.rangeVal("t5", 10, "t5", 19) {
+		if x.tenant != "t5" || x.ts != int64(10+n) {
+			t.Errorf("rangeVal: %v", x)
+		}
+		n++
+	}
+	it := tr.iterVal("t7", 0, "t7", 99, false, false, true, true)
+	for it.next() {
+		n++
+	}
+	if n != 110 {
+		t.Errorf("rangeVal + iterVal: %d", n)
+	}
+	tr.deleteVal("t0", 0)
+	if c := tr.deleteRangeVal("t1", 0, "t1", 50, true, false); c != 50 || tr.len() != 949 {
+		t.Errorf("deleteRangeVal: %d, len %d", c, tr.len())
+	}
+}
+
+type nbKV struct {
+	name string
+	nl   nbl `avlgen:"nbt,cmpval:byName(string),cmpval:byBytes([]byte),iter,seq"`
+}
+
+func (a *nbKV) cmp(b *nbKV) (bool, bool) {
+	return a.byName(b.name)
+}
+
+func (a *nbKV) byName(b string) (bool, bool) {
+	return a.name == b, a.name < b
+}
+
+func (a *nbKV) byBytes(b []byte) (bool, bool) {
+	return a.name == string(b), a.name < string(b)
+}
+
+func TestMultiCmpVal(t *testing.T) {
+	tr := nbt{}
+	for _, i := range rand.Perm(100) {
+		tr.insert(&nbKV{name: fmt.Sprintf("n%02d", i)})
+	}
+	buf := []byte("n42")
+	if n := tr.lookupValByBytes(buf); n == nil || n != tr.lookupVal("n42") {
+		t.Errorf("lookupValByBytes: %v", n)
+	}
+	if n := tr.searchValGEQByBytes([]byte("n42x")); n == nil || n.name != "n43" {
+		t.Errorf("searchValGEQByBytes: %v", n)
+	}
+	n := 0
+	for x := range tr.rangeValByBytes([]byte("n10"), []byte("n19")) {
+		if x.name != fmt.Sprintf("n1%d", n) {
+			t.Errorf("rangeValByBytes: %v", x)
+		}
+		n++
+	}
+	if n != 10 {
+		t.Errorf("rangeValByBytes: %d", n)
+	}
+	it := tr.iterValByBytes(nil, []byte("n09"), true, false, true, false)
+	n = 0
+	for it.next() {
+		n++
+	}
+	if n != 9 {
+		t.Errorf("iterValByBytes: %d", n)
+	}
+	it.reset(false)
+	it.seekValByBytes([]byte("n98"))
+	if !it.next() || it.value().name != "n98" {
+		t.Errorf("seekValByBytes")
+	}
+	tr.deleteValByBytes(buf)
+	if tr.lookupVal("n42") != nil {
+		t.Errorf("deleteValByBytes")
+	}
+}
@@ -0,0 +1,347 @@
+package trees
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type pKV struct {
+	k  int
+	pl pl `avlgen:"pkt,cmpval:cmpk(int),parent,iter,len,debug"`
+}
+
+func (a *pKV) cmp(b *pKV) (bool, bool) {
+	return a.k == b.k, a.k < b.k
+}
+
+func (a *pKV) cmpk(b int) (bool, bool) {
+	return a.k == b, a.k < b
+}
+
+func TestParentRandom(t *testing.T) {
+	const sz = 5000
+	tr := pkt{}
+	in := make(map[int]*pKV)
+	for i := 0; i < sz; i++ {
+		r := rand.Intn(sz)
+		if n := in[r]; n != nil {
+			if i%2 == 0 {
+				tr.delete(n)
+			} else {
+				tr.deleteVal(r)
+			}
+			delete(in, r)
+		} else {
+			n := &pKV{k: r}
+			tr.insert(n)
+			in[r] = n
+		}
+	}
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != len(in) {
+		t.Errorf("len %d != %d", tr.len(), len(in))
+	}
+}
+
+func TestParentDeleteOther(t *testing.T) {
+	tr1, tr2 := pkt{}, pkt{}
+	a := make([]pKV, 100)
+	for i := range a {
+		a[i].k = i
+		if i%2 == 0 {
+			tr1.insert(&a[i])
+		} else {
+			tr2.insert(&a[i])
+		}
+	}
+	for i := 1; i < 100; i += 2 {
+		tr1.delete(&a[i])
+		tr1.delete(&pKV{k: i - 1})
+	}
+	if tr1.len() != 50 || tr2.len() != 50 {
+		t.Errorf("len %d %d", tr1.len(), tr2.len())
+	}
+	for i := 0; i < 100; i += 2 {
+		tr1.delete(&a[i])
+		tr1.delete(&a[i])
+	}
+	if tr1.len() != 0 || tr1.n != nil {
+		t.Errorf("len %d", tr1.len())
+	}
+	checkTree(t, tr2.foreach, tr2.check)
+}
+
+func TestParentIterModify(t *testing.T) {
+	tr := pkt{}
+	for i := 0; i < 1000; i += 2 {
+		tr.insert(&pKV{k: i})
+	}
+	it := tr.iter(nil, nil, true, true)
+	expect := 0
+	for it.next() {
+		n := it.value()
+		if n.k != expect {
+			t.Fatalf("%d != %d", n.k, expect)
+		}
+		// Shuffle the tree around behind the iterator's back.
+		if n.k%2 == 0 {
+			tr.insert(&pKV{k: n.k + 1})
+		}
+		tr.deleteVal(n.k - 1)
+		expect++
+	}
+	if expect != 999 {
+		t.Errorf("iteration stopped at %d", expect)
+	}
+	checkTree(t, tr.foreach, tr.check)
+}
+
+func TestParentIterDeleteEnd(t *testing.T) {
+	tr := pkt{}
+	for i := 0; i < 100; i++ {
+		tr.insert(&pKV{k: i})
+	}
+	it := tr.iterVal(10, 20, false, false, true, true)
+	var got []int
+	for it.next() {
+		n := it.value()
+		got = append(got, n.k)
+		switch n.k {
+		case 12:
+			// The end of the iteration.
+			tr.deleteVal(20)
+		case 15:
+			// The current element and the new end.
+			tr.delete(n)
+			tr.deleteVal(19)
+		}
+	}
+	expect := []int{10, 11, 12, 13, 14, 15, 16, 17, 18}
+	if len(got) != len(expect) {
+		t.Fatalf("%v != %v", got, expect)
+	}
+	for i := range got {
+		if got[i] != expect[i] {
+			t.Fatalf("%v != %v", got, expect)
+		}
+	}
+
+	// Delete the end after it has been returned.
+	it = tr.iterVal(30, 40, false, false, true, true)
+	last := -1
+	for it.next() {
+		last = it.value().k
+		if last == 40 {
+			tr.deleteVal(40)
+		}
+	}
+	if last != 40 {
+		t.Errorf("iteration stopped at %d", last)
+	}
+
+	// Delete everything that's left of the iteration.
+	it = tr.iterVal(50, 60, false, false, true, true)
+	for it.next() {
+		if it.value().k != 50 {
+			t.Fatalf("unexpected %d", it.value().k)
+		}
+		for i := 50; i <= 60; i++ {
+			tr.deleteVal(i)
+		}
+	}
+	checkTree(t, tr.foreach, tr.check)
+}
+
+func TestParentNextPrev(t *testing.T) {
+	tr := pkt{}
+
+	for _, i := range rand.Perm(500) {
+		tr.insert(&pKV{k: i})
+	}
+	i := 0
+	for n := tr.first(); n != nil; n = tr.next(n) {
+		if n.k != i {
+			t.Errorf("next %d != %d", n.k, i)
+		}
+		i++
+	}
+	for n := tr.last(); n != nil; n = tr.prev(n) {
+		i--
+		if n.k != i {
+			t.Errorf("prev %d != %d", n.k, i)
+		}
+	}
+	if i != 0 {
+		t.Errorf("prev stopped at %d", i)
+	}
+}
+
+func TestParentIterDelete(t *testing.T) {
+	tr := pkt{}
+
+	for i := 0; i < 1000; i++ {
+		tr.insert(&pKV{k: i})
+	}
+	it := tr.iter(tr.last(), tr.first(), true, true)
+	i := 999
+	for it.next() {
+		n := it.value()
+		if n.k != i {
+			t.Errorf("%d != %d", n.k, i)
+		}
+		if n.k%2 == 0 {
+			it.deleteCurrent()
+		}
+		i--
+	}
+	if tr.len() != 500 {
+		t.Errorf("wrong number left: %d", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+}
+
+func TestParentIterSeek(t *testing.T) {
+	tr := pkt{}
+
+	for i := 0; i < 100; i++ {
+		tr.insert(&pKV{k: i})
+	}
+	it := tr.iter(nil, nil, true, true)
+	it.seekVal(50)
+	for i := 50; i < 60; i++ {
+		if !it.next() || it.value().k != i {
+			t.Fatalf("expected %d", i)
+		}
+	}
+	it.reverse()
+	for i := 58; i >= 0; i-- {
+		if !it.next() || it.value().k != i {
+			t.Fatalf("expected %d", i)
+		}
+	}
+	if it.next() {
+		t.Errorf("iteration didn't end: %v", it.value())
+	}
+	it.reset(false)
+	it.seek(tr.last())
+	if !it.next() || it.value().k != 99 || it.next() {
+		t.Errorf("seek to last")
+	}
+}
+
+func TestParentBuildSorted(t *testing.T) {
+	a := make([]*pKV, 1000)
+	for i := range a {
+		a[i] = &pKV{k: i}
+	}
+	tr := pkt{}
+	tr.buildSorted(a)
+	checkTree(t, tr.foreach, tr.check)
+	for i := 0; i < 1000; i += 3 {
+		tr.delete(a[i])
+	}
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != 666 {
+		t.Errorf("len %d", tr.len())
+	}
+}
+
+func TestParentReplaceContents(t *testing.T) {
+	a, b, c := &pKV{k: 1}, &pKV{k: 2}, &pKV{k: 3}
+	tr := pkt{}
+	tr.insert(a)
+	tr.insert(b)
+	tr.insert(c)
+	tr.buildSorted([]*pKV{b})
+	// a and c aren't in the tree anymore.
+	tr.delete(a)
+	tr.delete(c)
+	if tr.len() != 1 || tr.first() != b {
+		t.Errorf("buildSorted: len %d", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+
+	// Rebuilding from the elements of the tree itself.
+	tr.insert(a)
+	tr.insert(c)
+	tr.buildSorted([]*pKV{a, b, c})
+	if tr.len() != 3 {
+		t.Errorf("buildSorted itself: len %d", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+
+	l, r := pkt{}, pkt{}
+	for i := 0; i < 10; i++ {
+		l.insert(&pKV{k: i})
+		r.insert(&pKV{k: i + 20})
+	}
+	tr.join(l, &pKV{k: 15}, r)
+	tr.delete(a)
+	tr.delete(c)
+	if tr.len() != 21 || tr.lookupVal(2) == b {
+		t.Errorf("join: len %d", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+
+	old := tr.first()
+	l, r = pkt{}, pkt{}
+	l.insert(&pKV{k: 100})
+	r.insert(&pKV{k: 200})
+	tr.concat(l, r)
+	tr.delete(old)
+	if tr.len() != 2 {
+		t.Errorf("concat: len %d", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+
+	// Appending to the tree itself keeps its elements.
+	r = pkt{}
+	r.insert(&pKV{k: 300})
+	tr.concat(tr, r)
+	l = pkt{}
+	l.insert(&pKV{k: 0})
+	tr.concat(l, tr)
+	if tr.len() != 4 || tr.first().k != 0 || tr.last().k != 300 {
+		t.Errorf("concat itself: len %d", tr.len())
+	}
+	checkTree(t, tr.foreach, tr.check)
+}
+
+func TestParentPop(t *testing.T) {
+	tr := pkt{}
+	for _, i := range rand.Perm(100) {
+		tr.insert(&pKV{k: i})
+	}
+	for i := 0; i < 50; i++ {
+		n := tr.popFirst()
+		if n.k != i {
+			t.Fatalf("popFirst %d != %d", n.k, i)
+		}
+		// Popped elements are not in the tree anymore.
+		tr.delete(n)
+		tr.delete(tr.popLast())
+	}
+	if tr.len() != 0 {
+		t.Errorf("len %d", tr.len())
+	}
+}
+
+func TestParentClear(t *testing.T) {
+	a := make([]pKV, 100)
+	tr := pkt{}
+	for i := range a {
+		a[i].k = i
+		tr.insert(&a[i])
+	}
+	tr.clear(false)
+	for i := range a {
+		if a[i].pl != (pl{}) {
+			t.Errorf("%d not unlinked", i)
+		}
+	}
+	tr.insert(&a[0])
+	tr.delete(&a[1])
+	if tr.len() != 1 {
+		t.Errorf("len %d", tr.len())
+	}
+}
@@ -0,0 +1,197 @@
+package trees
+
+import (
+	"math/rand"
+	"testing"
+)
+
+type rKV struct {
+	k  int
+	rl rl `avlgen:"rkt,cmpval:cmpk(int),rank,len,debug"`
+}
+
+func (a *rKV) cmp(b *rKV) (bool, bool) {
+	return a.k == b.k, a.k < b.k
+}
+
+func (a *rKV) cmpk(b int) (bool, bool) {
+	return a.k == b, a.k < b
+}
+
+func TestRankNth(t *testing.T) {
+	tr := rkt{}
+
+	for _, i := range rand.Perm(1000) {
+		tr.insert(&rKV{k: i * 2})
+	}
+	checkTree(t, tr.foreach, tr.check)
+	for i := 0; i < 1000; i++ {
+		n := tr.nth(i)
+		if n == nil || n.k != i*2 {
+			t.Fatalf("nth(%d): %v", i, n)
+		}
+		if r := tr.rank(n); r != i {
+			t.Errorf("rank(%d) = %d", n.k, r)
+		}
+		if r := tr.rankVal(i * 2); r != i {
+			t.Errorf("rankVal(%d) = %d", i*2, r)
+		}
+		if r := tr.rankVal(i*2 + 1); r != i+1 {
+			t.Errorf("rankVal(%d) = %d", i*2+1, r)
+		}
+	}
+	if n := tr.nth(1000); n != nil {
+		t.Errorf("nth(1000): %v", n)
+	}
+	if n := tr.nth(-1); n != nil {
+		t.Errorf("nth(-1): %v", n)
+	}
+	if r := tr.rank(&rKV{k: 17}); r != -1 {
+		t.Errorf("rank of missing: %d", r)
+	}
+}
+
+func TestRankCountRange(t *testing.T) {
+	tr := rkt{}
+
+	for i := 0; i < 100; i++ {
+		tr.insert(&rKV{k: i})
+	}
+	tests := []struct {
+		s, e       int
+		incs, ince bool
+		c          int
+	}{
+		{10, 20, true, true, 11},
+		{10, 20, false, true, 10},
+		{10, 20, true, false, 10},
+		{10, 20, false, false, 9},
+		{-5, 200, false, false, 100},
+		{20, 10, true, true, 0},
+		{42, 42, true, true, 1},
+		{42, 42, true, false, 0},
+	}
+	for _, tc := range tests {
+		if c := tr.countRange(tc.s, tc.e, tc.incs, tc.ince); c != tc.c {
+			t.Errorf("countRange(%d, %d, %v, %v) = %d, expected %d", tc.s, tc.e, tc.incs, tc.ince, c, tc.c)
+		}
+	}
+}
+
+func TestRankRandom(t *testing.T) {
+	const sz = 5000
+	tr := rkt{}
+	in := make(map[int]bool)
+	for i := 0; i < sz; i++ {
+		r := rand.Intn(sz)
+		if in[r] {
+			tr.deleteVal(r)
+			delete(in, r)
+		} else {
+			tr.insert(&rKV{k: r})
+			in[r] = true
+		}
+	}
+	tr.deleteVal(sz + 1)
+	tr.delete(&rKV{k: sz + 1})
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != len(in) {
+		t.Errorf("len %d != %d", tr.len(), len(in))
+	}
+}
+
+func TestRankBuildSorted(t *testing.T) {
+	for _, sz := range []int{0, 1, 2, 3, 7, 8, 1000} {
+		a := make([]*rKV, sz)
+		for i := range a {
+			a[i] = &rKV{k: i}
+		}
+		tr := rkt{}
+		tr.insert(&rKV{k: 17})
+		tr.buildSorted(a)
+		checkTree(t, tr.foreach, tr.check)
+		if tr.len() != sz {
+			t.Errorf("len %d != %d", tr.len(), sz)
+		}
+		for i := range a {
+			if n := tr.nth(i); n != a[i] {
+				t.Errorf("nth(%d) = %v", i, n)
+			}
+		}
+	}
+}
+
+func TestRankPop(t *testing.T) {
+	tr := rkt{}
+	for _, i := range rand.Perm(1000) {
+		tr.insert(&rKV{k: i})
+	}
+	for i := 0; i < 500; i++ {
+		if n := tr.popFirst(); n == nil || n.k != i {
+			t.Fatalf("popFirst %v != %d", n, i)
+		}
+		if n := tr.popLast(); n == nil || n.k != 999-i {
+			t.Fatalf("popLast %v != %d", n, 999-i)
+		}
+		if tr.len() != 998-i*2 {
+			t.Fatalf("len %d", tr.len())
+		}
+		if i%100 == 0 {
+			checkTree(t, tr.foreach, tr.check)
+		}
+	}
+	if tr.popFirst() != nil || tr.popLast() != nil {
+		t.Errorf("pop from empty tree")
+	}
+}
+
+func TestRankClear(t *testing.T) {
+	a := make([]rKV, 100)
+	tr := rkt{}
+	for i := range a {
+		a[i].k = i
+		tr.insert(&a[i])
+	}
+	tr.clear(false)
+	if tr.n != nil || tr.len() != 0 {
+		t.Errorf("clear(false) left %d", tr.len())
+	}
+	for i := range a {
+		tr.insert(&a[i])
+	}
+	tr.clear(true)
+	if tr.n != nil {
+		t.Errorf("clear(true) didn't empty")
+	}
+	for i := range a {
+		if a[i].rl != (rl{}) {
+			t.Errorf("%d not unlinked: %v", i, a[i].rl)
+		}
+	}
+}
+
+func TestRankDelete(t *testing.T) {
+	const sz = 5000
+	tr := rkt{}
+	a := make([]rKV, sz)
+	for _, i := range rand.Perm(sz) {
+		a[i].k = i
+		tr.insert(&a[i])
+	}
+	for i, j := range rand.Perm(sz) {
+		if i%2 == 0 {
+			tr.delete(&a[j])
+		} else {
+			tr.deleteVal(j)
+		}
+		if i%500 == 0 {
+			checkTree(t, tr.foreach, tr.check)
+			if tr.len() != sz-i-1 {
+				t.Fatalf("len %d != %d", tr.len(), sz-i-1)
+			}
+		}
+	}
+	if tr.n != nil {
+		t.Errorf("tree not empty")
+	}
+}
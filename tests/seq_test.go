@@ -0,0 +1,72 @@
+package trees
+
+import (
+	"iter"
+	"testing"
+)
+
+type sqKV struct {
+	k  int
+	sl sql `avlgen:"sqt,cmpval:cmpk(int),seq"`
+}
+
+func (a *sqKV) cmp(b *sqKV) (bool, bool) {
+	return a.k == b.k, a.k < b.k
+}
+
+func (a *sqKV) cmpk(b int) (bool, bool) {
+	return a.k == b, a.k < b
+}
+
+func TestSeq(t *testing.T) {
+	tr := sqt{}
+
+	for i := 0; i < 1000; i++ {
+		tr.insert(&sqKV{k: i})
+	}
+	i := 0
+	for n := range tr.all() {
+		if n.k != i {
+			t.Errorf("all %d != %d", n.k, i)
+		}
+		i++
+	}
+	if i != 1000 {
+		t.Errorf("all stopped at %d", i)
+	}
+	for n := range tr.backward() {
+		i--
+		if n.k != i {
+			t.Errorf("backward %d != %d", n.k, i)
+		}
+		if i == 500 {
+			break
+		}
+	}
+	if i != 500 {
+		t.Errorf("backward didn't break at %d", i)
+	}
+	i = 17
+	for n := range tr.rangeVal(17, 42) {
+		if n.k != i {
+			t.Errorf("rangeVal %d != %d", n.k, i)
+		}
+		i++
+	}
+	if i != 43 {
+		t.Errorf("rangeVal stopped at %d", i)
+	}
+	for n := range tr.rangeVal(42, 17) {
+		t.Errorf("empty rangeVal returned %v", n)
+	}
+	next, stop := iter.Pull(tr.rangeVal(-10, 1))
+	defer stop()
+	for i := 0; i < 2; i++ {
+		if n, ok := next(); !ok || n.k != i {
+			t.Errorf("pull %d: %v %v", i, n, ok)
+		}
+	}
+	if n, ok := next(); ok {
+		t.Errorf("pull past end: %v", n)
+	}
+}
@@ -0,0 +1,257 @@
+package trees
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSplitJoin(t *testing.T) {
+	const sz = 1000
+	for _, x := range []int{-1, 0, 1, 17, 500, 998, 999, 1000} {
+		tr := rkt{}
+		for _, i := range rand.Perm(sz) {
+			tr.insert(&rKV{k: i})
+		}
+		lt, ge := tr.split(x)
+		if tr.n != nil {
+			t.Errorf("split didn't empty the tree")
+		}
+		checkTree(t, lt.foreach, lt.check)
+		checkTree(t, ge.foreach, ge.check)
+		el := x
+		if el < 0 {
+			el = 0
+		} else if el > sz {
+			el = sz
+		}
+		if lt.len() != el || ge.len() != sz-el {
+			t.Errorf("split(%d) %d %d", x, lt.len(), ge.len())
+		}
+		if l := lt.last(); l != nil && l.k >= x {
+			t.Errorf("split(%d) lt last %d", x, l.k)
+		}
+		if f := ge.first(); f != nil && f.k < x {
+			t.Errorf("split(%d) ge first %d", x, f.k)
+		}
+		tr.concat(lt, ge)
+		checkTree(t, tr.foreach, tr.check)
+		for i := 0; i < sz; i++ {
+			if n := tr.nth(i); n.k != i {
+				t.Fatalf("concat nth(%d) = %d", i, n.k)
+			}
+		}
+	}
+}
+
+func TestSplitJoinUneven(t *testing.T) {
+	l, r := rkt{}, rkt{}
+	for i := 0; i < 1000; i++ {
+		l.insert(&rKV{k: i})
+	}
+	for i := 1001; i < 1010; i++ {
+		r.insert(&rKV{k: i})
+	}
+	tr := rkt{}
+	tr.join(l, &rKV{k: 1000}, r)
+	checkTree(t, tr.foreach, tr.check)
+	l, r = tr.split(5)
+	r2, l2 := rkt{}, rkt{}
+	r2.join(r, &rKV{k: 1010}, rkt{})
+	checkTree(t, r2.foreach, r2.check)
+	l2.join(rkt{}, &rKV{k: -1}, l)
+	checkTree(t, l2.foreach, l2.check)
+	tr.concat(l2, r2)
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != 1012 || tr.first().k != -1 || tr.last().k != 1010 {
+		t.Errorf("bad join %d %d %d", tr.len(), tr.first().k, tr.last().k)
+	}
+}
+
+func TestSplitJoinParent(t *testing.T) {
+	tr := pkt{}
+	for _, i := range rand.Perm(1000) {
+		tr.insert(&pKV{k: i})
+	}
+	lt, ge := tr.split(300)
+	checkTree(t, lt.foreach, lt.check)
+	checkTree(t, ge.foreach, ge.check)
+	tr.concat(lt, ge)
+	checkTree(t, tr.foreach, tr.check)
+	for i := 0; i < 1000; i += 2 {
+		tr.deleteVal(i)
+	}
+	checkTree(t, tr.foreach, tr.check)
+	if tr.len() != 500 {
+		t.Errorf("len %d", tr.len())
+	}
+}
+
+func setOpTrees(a, b []int) (rkt, rkt) {
+	ta, tb := rkt{}, rkt{}
+	for _, k := range a {
+		ta.insert(&rKV{k: k})
+	}
+	for _, k := range b {
+		tb.insert(&rKV{k: k})
+	}
+	return ta, tb
+}
+
+func setOpCheck(t *testing.T, tr *rkt, expect func(int) bool, max int) {
+	t.Helper()
+	checkTree(t, tr.foreach, tr.check)
+	c := 0
+	for i := 0; i < max; i++ {
+		n := tr.lookupVal(i)
+		if (n != nil) != expect(i) {
+			t.Errorf("%d: %v", i, n)
+		}
+		if n != nil {
+			c++
+		}
+	}
+	if c != tr.len() {
+		t.Errorf("len %d != %d", tr.len(), c)
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	var a, b []int
+	for i := 0; i < 3000; i++ {
+		if i%2 == 0 {
+			a = append(a, i)
+		}
+		if i%3 == 0 && i < 2000 {
+			b = append(b, i)
+		}
+	}
+	t.Run("union", func(t *testing.T) {
+		ta, tb := setOpTrees(a, b)
+		conflicts := 0
+		ta.union(&tb, func(x, y *rKV) *rKV {
+			conflicts++
+			return y
+		})
+		if tb.n != nil {
+			t.Errorf("other tree not empty")
+		}
+		if conflicts != 334 {
+			t.Errorf("conflicts %d", conflicts)
+		}
+		setOpCheck(t, &ta, func(i int) bool { return i%2 == 0 || (i%3 == 0 && i < 2000) }, 3000)
+	})
+	t.Run("intersection", func(t *testing.T) {
+		ta, tb := setOpTrees(a, b)
+		ta.intersection(&tb, nil)
+		setOpCheck(t, &ta, func(i int) bool { return i%6 == 0 && i < 2000 }, 3000)
+	})
+	t.Run("difference", func(t *testing.T) {
+		ta, tb := setOpTrees(a, b)
+		ta.difference(&tb)
+		setOpCheck(t, &ta, func(i int) bool { return i%2 == 0 && (i%3 != 0 || i >= 2000) }, 3000)
+		setOpCheck(t, &tb, func(i int) bool { return i%3 == 0 && i < 2000 }, 3000)
+	})
+	t.Run("empty", func(t *testing.T) {
+		ta, tb := setOpTrees(a, nil)
+		ta.union(&tb, nil)
+		ta.difference(&tb)
+		tb.union(&ta, nil)
+		setOpCheck(t, &tb, func(i int) bool { return i%2 == 0 }, 3000)
+		tb.intersection(&ta, nil)
+		if tb.n != nil {
+			t.Errorf("intersection with empty not empty")
+		}
+	})
+	t.Run("allocs", func(t *testing.T) {
+		ta, tb := setOpTrees(a, b)
+		allocs := testing.AllocsPerRun(1, func() {
+			ta.union(&tb, nil)
+			ta.difference(&tb)
+		})
+		if allocs != 0 {
+			t.Errorf("allocs %v", allocs)
+		}
+	})
+}
+
+func TestSetOpsParent(t *testing.T) {
+	ta, tb := pkt{}, pkt{}
+	var bs []*pKV
+	for i := 0; i < 1000; i++ {
+		ta.insert(&pKV{k: i * 2})
+		n := &pKV{k: i * 3}
+		tb.insert(n)
+		bs = append(bs, n)
+	}
+	ta.intersection(&tb, func(x, y *pKV) *pKV { return y })
+	checkTree(t, ta.foreach, ta.check)
+	if ta.len() != 334 {
+		t.Errorf("len %d", ta.len())
+	}
+	// Dropped elements must not be deletable from the tree.
+	for _, n := range bs {
+		if n.k%2 == 0 {
+			ta.delete(n)
+		} else if n.pl.parent != nil {
+			t.Errorf("dropped %d still linked", n.k)
+		}
+	}
+	if ta.len() != 0 {
+		t.Errorf("len %d", ta.len())
+	}
+}
+
+func TestDeleteRangeVal(t *testing.T) {
+	const sz = 1000
+	tests := []struct {
+		lo, hi       int
+		incLo, incHi bool
+		n            int
+	}{
+		{10, 20, true, true, 11},
+		{10, 20, false, true, 10},
+		{10, 20, true, false, 10},
+		{10, 20, false, false, 9},
+		{-5, 2000, true, true, sz},
+		{20, 10, true, true, 0},
+		{500, 500, true, true, 1},
+		{500, 500, false, true, 0},
+		{0, 998, true, false, 998},
+	}
+	for _, tc := range tests {
+		in := func(k int) bool {
+			return (k > tc.lo || tc.incLo && k == tc.lo) && (k < tc.hi || tc.incHi && k == tc.hi)
+		}
+		tr, ptr, itr := rkt{}, pkt{}, ikvt{}
+		pn := make([]*pKV, sz)
+		for _, i := range rand.Perm(sz) {
+			tr.insert(&rKV{k: i})
+			pn[i] = &pKV{k: i}
+			ptr.insert(pn[i])
+			itr.insert(&iKV{k: i})
+		}
+		if n := tr.deleteRangeVal(tc.lo, tc.hi, tc.incLo, tc.incHi); n != tc.n || tr.len() != sz-n {
+			t.Errorf("deleteRangeVal(%v): %d, len %d", tc, n, tr.len())
+		}
+		if n := ptr.deleteRangeVal(tc.lo, tc.hi, tc.incLo, tc.incHi); n != tc.n || ptr.len() != sz-n {
+			t.Errorf("parent deleteRangeVal(%v): %d, len %d", tc, n, ptr.len())
+		}
+		if n := itr.deleteRangeVal(tc.lo, tc.hi, tc.incLo, tc.incHi); n != tc.n {
+			t.Errorf("ikvt deleteRangeVal(%v): %d", tc, n)
+		}
+		checkTree(t, tr.foreach, tr.check)
+		checkTree(t, ptr.foreach, ptr.check)
+		for i := 0; i < sz; i++ {
+			if (tr.lookupVal(i) == nil) != in(i) || (itr.lookupVal(i) == nil) != in(i) {
+				t.Errorf("deleteRangeVal(%v): %d wrong", tc, i)
+			}
+			// Deleting a deleted element again must be harmless.
+			if in(i) {
+				ptr.delete(pn[i])
+			}
+		}
+		if ptr.len() != sz-tc.n {
+			t.Errorf("parent deleteRangeVal(%v): len %d after delete", tc, ptr.len())
+		}
+	}
+}
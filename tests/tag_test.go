@@ -0,0 +1,114 @@
+package trees
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"github.com/art4711/avlgen/avlgen"
+)
+
+// Generate a tree for the node type declared in src and type check
+// the result.
+func genCheck(t *testing.T, nodeT, linkT, linkN, tag string, fields, pkgs map[string]string, src string) {
+	t.Helper()
+	trees := avlgen.New("x")
+	trees.FieldPkgs = pkgs
+	if err := trees.AddTreeFields(nodeT, linkT, linkN, "", tag, fields); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := trees.Gen(&out); err != nil {
+		t.Fatal(err)
+	}
+	fs := token.NewFileSet()
+	var files []*ast.File
+	for _, s := range []string{out.String(), "package x\n" + src} {
+		f, err := parser.ParseFile(fs, "", s, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tag, err)
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{Importer: importer.Default()}
+	if _, err := conf.Check("x", fs, files, nil); err != nil {
+		t.Errorf("%s: %v", tag, err)
+	}
+}
+
+func TestTagDescInterval(t *testing.T) {
+	fields := map[string]string{"lo": "int", "hi": "int"}
+	for _, tag := range []string{"ivt,interval:lo,hi,desc", "ivt,desc,interval:lo,hi"} {
+		err := avlgen.New("trees").AddTreeFields("iv", "ivl", "l", "", tag, fields)
+		if err == nil {
+			t.Errorf("%s: no error", tag)
+		}
+	}
+	if err := avlgen.New("trees").AddTreeFields("iv", "ivl", "l", "", "ivt,interval:lo,hi", fields); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTagIntervalImports(t *testing.T) {
+	src := `
+type iv struct {
+	lo, hi int
+	l      ivl
+}
+
+func (a *iv) cmp(b *iv) (bool, bool) {
+	return a.lo == b.lo, a.lo < b.lo
+}
+`
+	fields := map[string]string{"lo": "int", "hi": "int"}
+	genCheck(t, "iv", "ivl", "l", "ivt,interval:lo,hi,no:overlaps,no:stabbing", fields, nil, src)
+
+	src = `
+import "time"
+
+type iv struct {
+	lo, hi time.Duration
+	l      ivl
+}
+
+func (a *iv) cmp(b *iv) (bool, bool) {
+	return a.lo == b.lo, a.lo < b.lo
+}
+`
+	fields = map[string]string{"lo": "time.Duration", "hi": "time.Duration"}
+	genCheck(t, "iv", "ivl", "l", "ivt,interval:lo,hi", fields, nil, src)
+
+	// The package under another name.
+	src = `
+import tm "time"
+
+type iv struct {
+	lo, hi tm.Duration
+	l      ivl
+}
+
+func (a *iv) cmp(b *iv) (bool, bool) {
+	return a.lo == b.lo, a.lo < b.lo
+}
+`
+	fields = map[string]string{"lo": "tm.Duration", "hi": "tm.Duration"}
+	genCheck(t, "iv", "ivl", "l", "ivt,interval:lo,hi", fields, map[string]string{"tm": "time"}, src)
+}
+
+func TestTagKeyImports(t *testing.T) {
+	src := `
+import "time"
+
+type kd struct {
+	name string
+	d    time.Duration
+	l    kdl
+}
+`
+	fields := map[string]string{"name": "string", "d": "time.Duration"}
+	genCheck(t, "kd", "kdl", "l", "kdt,key:d,name desc,rank", fields, nil, src)
+}